@@ -1,11 +1,16 @@
 package barneshut
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
+	"hash/fnv"
 	"math"
 	"os"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const SOFTENING = 0.000000001
@@ -13,26 +18,52 @@ const SOFTENING = 0.000000001
 const THETA = 0.5
 
 type Particle struct {
-	// Assuming unit mass
+	// fx, fy are the force per unit mass, i.e. the acceleration.
 	x, y, vx, vy, fx, fy float64
+	mass                 float64
+	interactions         int32 // Nodes used in the last force calculation, the costzones weight.
+	ghost                bool  // Copy of a remote source in a distributed run, never moved.
+	id                   int64 // Stable identity, kept through the tree rebuilds.
 }
 
+/*
+** Creates a particle of unit mass at rest.
+ */
 func NewParticle(x float64, y float64) *Particle {
 	particle := new(Particle)
 	particle.x, particle.y = x, y
 	particle.vx, particle.vy, particle.fx, particle.fy = 0.0, 0.0, 0.0, 0.0
+	particle.mass = 1.0
 	return particle
 }
 
+func (particle *Particle) ID() int64 {
+	return particle.id
+}
+
+func (particle *Particle) SetID(id int64) {
+	particle.id = id
+}
+
 type BarnesHutNode struct {
 	centerX, centerY                     float64 // Used to divide the subquadrants.
-	totalMass                            float64 // 1.0 if 1 particle else total mass of the children.
+	totalMass                            float64 // Mass of the particle if 1 particle else total mass of the children.
+	nParticles                           int32   // Particles in the subtree, set with the COM by the schedulers.
 	comX, comY                           float64 // Center of Mass X & Y positions.
 	leftX, rightX, topY, botY            float64 // Bounds for the quadrant.
 	particle                             *Particle
 	topLeft, botLeft, topRight, botRight *BarnesHutNode
 }
 
+// The subquadrants in tree order, any of them may be nil.
+func (node *BarnesHutNode) quadrants() [4]*BarnesHutNode {
+	return [4]*BarnesHutNode{node.topLeft, node.topRight, node.botLeft, node.botRight}
+}
+
+func (node *BarnesHutNode) isLeaf() bool {
+	return node.topLeft == nil && node.topRight == nil && node.botLeft == nil && node.botRight == nil
+}
+
 /*
 ** Create Nodes for the Quadrants.
  */
@@ -116,7 +147,7 @@ func CalcCenterOfMass(node *BarnesHutNode) {
 	if node.topLeft == nil && node.topRight == nil && node.botLeft == nil && node.botRight == nil {
 		// In leaf node the COM would be the same as the particle.
 		if node.particle != nil {
-			node.totalMass = 1.0
+			node.totalMass = node.particle.mass
 			node.comX = node.particle.x
 			node.comY = node.particle.y
 		}
@@ -188,6 +219,7 @@ func ForceByNode(particle *Particle, node *BarnesHutNode) {
 	var invDist3 float64 = invDist * invDist * invDist
 	particle.fx += dx * node.totalMass * invDist3
 	particle.fy += node.totalMass * dy * invDist3
+	particle.interactions++
 }
 
 /*
@@ -226,6 +258,7 @@ func ForceCalculation(particle *Particle, node *BarnesHutNode) {
 ** calc and store the new velocity of the particle
  */
 func CalcVelocity(particle *Particle, root *BarnesHutNode, dt float64) {
+	particle.interactions = 0
 	ForceCalculation(particle, root)
 	particle.vx += dt * particle.fx
 	particle.vy += dt * particle.fy
@@ -335,10 +368,37 @@ func FprintDataFile(file *os.File, root *BarnesHutNode) {
 	FprintDataFile(file, root.botRight)
 }
 
+/*
+** Same as FprintDataFile, but with the shortest representation that reads back
+** to the exact float64, so runs can be compared bit for bit.
+ */
+func FprintDataFileExact(file *os.File, root *BarnesHutNode) {
+	forEachParticleIn(root, func(particle *Particle) {
+		fmt.Fprintf(file, "%s %s\n", strconv.FormatFloat(particle.x, 'g', -1, 64), strconv.FormatFloat(particle.y, 'g', -1, 64))
+	})
+}
+
+/*
+** FNV-1a hash of the bit patterns of every particle's position and velocity, in
+** tree order. Equal checksums mean bit-identical particle states.
+ */
+func Checksum(root *BarnesHutNode) uint64 {
+	hash := fnv.New64a()
+	var buf [8]byte
+	forEachParticleIn(root, func(particle *Particle) {
+		for _, v := range [4]float64{particle.x, particle.y, particle.vx, particle.vy} {
+			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+			hash.Write(buf[:])
+		}
+	})
+	return hash.Sum64()
+}
+
 /************* DEQUEU **************/
 
 type Task struct {
-	Node *BarnesHutNode
+	Node  *BarnesHutNode
+	Depth int // Depth of Node in the tree, the root is 0.
 }
 
 // Using Linked LIst implementation of Deque.
@@ -427,6 +487,29 @@ func (d *Deque) PopBack() (Task, bool) {
 	return t, true
 }
 
+/*
+** Removes the back half of the deque (rounded up), for batch stealing.
+** The first task returned was the back of the deque.
+ */
+func (d *Deque) PopBackHalf() []Task {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := (d.size + 1) / 2
+	tasks := make([]Task, 0, n)
+	for i := int32(0); i < n; i++ {
+		tasks = append(tasks, *d.tail.task)
+		d.tail = d.tail.prev
+		if d.tail != nil {
+			d.tail.next = nil
+		} else {
+			d.head = nil
+		}
+		d.size--
+	}
+	return tasks
+}
+
 func (d *Deque) Len() int32 {
 	d.mu.Lock()
 	defer d.mu.Unlock()
@@ -445,7 +528,7 @@ func CalcCenterOfMassParallel(node *BarnesHutNode, activeThreads *int32, numThre
 	if node.topLeft == nil && node.topRight == nil && node.botLeft == nil && node.botRight == nil {
 		// In leaf node the COM would be the same as the particle.
 		if node.particle != nil {
-			node.totalMass = 1.0
+			node.totalMass = node.particle.mass
 			node.comX = node.particle.x
 			node.comY = node.particle.y
 		}
@@ -545,153 +628,161 @@ func CalcCenterOfMassParallel(node *BarnesHutNode, activeThreads *int32, numThre
 	}
 }
 
-func RunSimulation(root *BarnesHutNode, numThreads int, dt float64, nParticles int) {
-	// Synchronization primitives
-	var wg sync.WaitGroup
-	var activeThreads int32 = 1
-	var velocityTasksProcessed int32 = 0
-	var positionTasksProcessed int32 = 0
+/*
+** Runs one time-step: COM, velocities and positions, distributed by the scheduler.
+** Returns the time spent in each phase and what every worker did.
+ */
+func RunSimulation(root *BarnesHutNode, sched Scheduler, dt float64, nParticles int) Stats {
+	stats, _ := RunSimulationContext(context.Background(), root, sched, dt, nParticles)
+	return stats
+}
 
-	// Ensure center of mass is calculated first
-	CalcCenterOfMassParallel(root, &activeThreads, numThreads)
+/*
+** Returned when the context ends during a time-step.
+** The particles are left as they were at the end of the last completed step.
+ */
+type CancelledError struct {
+	Phase Phase // The phase that was interrupted.
+	Err   error // The context's error.
+}
 
-	// Initialize work-stealing deques
-	deques := make([]*Deque, numThreads)
-	for i := 0; i < numThreads; i++ {
-		deques[i] = NewDeque()
-	}
+func (err *CancelledError) Error() string {
+	return fmt.Sprintf("simulation cancelled during %s phase: %v", err.Phase, err.Err)
+}
 
-	// Velocity Calculation Phase
-	deques[0].PushFront(Task{Node: root})
-	wg.Add(numThreads)
-	for t := 0; t < numThreads; t++ {
-		go func(threadNum int) {
-			defer wg.Done()
-			calcVelocityWorker(root, dt, threadNum, deques, numThreads, &velocityTasksProcessed, nParticles)
-		}(t)
+func (err *CancelledError) Unwrap() error {
+	return err.Err
+}
+
+/*
+** Like RunSimulation, but the workers stop between tasks once ctx is done and a
+** *CancelledError is returned. The velocity phase only accumulates the forces and
+** the position phase, which is not interrupted, applies them to the velocities and
+** positions, so a cancelled step leaves the positions and velocities untouched.
+ */
+func RunSimulationContext(ctx context.Context, root *BarnesHutNode, sched Scheduler, dt float64, nParticles int) (Stats, error) {
+	stats := NewStats(sched)
+
+	// Ensure center of mass is calculated first
+	stats.runPhase(PhaseCenterOfMass, func(counters []WorkerCounters) {
+		sched.CenterOfMass(ctx, root, counters)
+	})
+	if err := ctx.Err(); err != nil {
+		return stats, &CancelledError{Phase: PhaseCenterOfMass, Err: err}
 	}
-	wg.Wait()
 
-	// Reset deques and prepare for position update
-	for i := 0; i < numThreads; i++ {
-		deques[i] = NewDeque()
+	// Velocity Calculation Phase
+	stats.runPhase(PhaseVelocity, func(counters []WorkerCounters) {
+		sched.ForEachParticle(ctx, root, nParticles, func(particle *Particle) {
+			if particle.ghost {
+				return
+			}
+			particle.fx, particle.fy = 0.0, 0.0
+			particle.interactions = 0
+			ForceCalculation(particle, root)
+		}, counters)
+	})
+	if err := ctx.Err(); err != nil {
+		// Drop the forces of the particles done so far.
+		forEachParticleIn(root, func(particle *Particle) {
+			particle.fx, particle.fy = 0.0, 0.0
+		})
+		return stats, &CancelledError{Phase: PhaseVelocity, Err: err}
 	}
-	deques[0].PushFront(Task{Node: root})
 
 	// Position Update Phase
-	wg.Add(numThreads)
-	for t := 0; t < numThreads; t++ {
-		go func(threadNum int) {
-			defer wg.Done()
-			updatePositionWorker(dt, threadNum, deques, numThreads, &positionTasksProcessed, nParticles)
-		}(t)
-	}
-	wg.Wait()
+	stats.runPhase(PhasePosition, func(counters []WorkerCounters) {
+		sched.ForEachParticle(context.Background(), root, nParticles, func(particle *Particle) {
+			if particle.ghost {
+				return
+			}
+			particle.vx += dt * particle.fx
+			particle.vy += dt * particle.fy
+			UpdatePosition(particle, dt)
+		}, counters)
+	})
+	stats.Steps = 1
+	return stats, nil
 }
 
-func calcVelocityWorker(root *BarnesHutNode, dt float64, threadNum int, deques []*Deque, numThreads int, tasksProcessed *int32, nParticles int) {
-	for {
-		task, found := deques[threadNum].PopFront()
-		if !found {
-			// Unable to find task in its own queue so stealing now.
-			// WORK STEALING
-			task = stealTask(threadNum, deques, numThreads)
-			if task.Node == nil {
-				// Keep checking until all particles processed.
-				if atomic.LoadInt32(tasksProcessed) >= int32(nParticles) {
-					return
-				}
-				continue
-			}
-		}
-		processVelocitySubtree(root, task.Node, dt, threadNum, deques, tasksProcessed)
-	}
+/*
+** Moves the particle by its velocity. The forces are kept as the accelerations of
+** the last step, and reset when the next step computes them.
+ */
+func UpdatePosition(particle *Particle, dt float64) {
+	particle.x += particle.vx * dt
+	particle.y += particle.vy * dt
 }
 
-func updatePositionWorker(dt float64, threadNum int, deques []*Deque, numThreads int, tasksProcessed *int32, nParticles int) {
-	for {
+func stealingWorker(done <-chan struct{}, fn func(*Particle), thief *thief, deques []*Deque, tasksProcessed *int32, nParticles int, cutoff subtreeCutoff, counters *WorkerCounters) {
+	threadNum := thief.threadNum
+	start := time.Now()
+	var idle time.Duration
+	var idleSince time.Time // Zero while the worker has work.
+	defer func() {
+		counters.Busy += time.Since(start) - idle
+	}()
+
+	for !cancelled(done) {
 		task, found := deques[threadNum].PopFront()
 		if !found {
 			// Unable to find task in its own queue so stealing now.
 			// WORK STEALING
-			task = stealTask(threadNum, deques, numThreads)
+			task = thief.stealTask(deques, counters)
 			if task.Node == nil {
+				if idleSince.IsZero() {
+					idleSince = time.Now()
+				}
 				// Keep checking until all particles processed.
 				if atomic.LoadInt32(tasksProcessed) >= int32(nParticles) {
+					idle += time.Since(idleSince)
 					return
 				}
 				continue
 			}
 		}
-		processPositionSubtree(dt, task.Node, threadNum, deques, tasksProcessed)
-	}
-}
-
-// WORK STEALING
-func stealTask(threadNum int, deques []*Deque, numThreads int) Task {
-	for i := 0; i < numThreads; i++ {
-		victim := (threadNum + i) % numThreads
-		if victim == threadNum {
-			continue
-		}
-		stolenTask, foundThisTime := deques[victim].PopBack()
-		if foundThisTime {
-			return stolenTask
+		if !idleSince.IsZero() {
+			idle += time.Since(idleSince)
+			idleSince = time.Time{}
 		}
+		counters.Tasks++
+		processSubtree(fn, task, threadNum, deques, tasksProcessed, cutoff)
+	}
+	if !idleSince.IsZero() {
+		idle += time.Since(idleSince)
 	}
-	return Task{Node: nil}
 }
 
-func processVelocitySubtree(root, node *BarnesHutNode, dt float64, threadNum int, deques []*Deque, tasksProcessed *int32) {
+func processSubtree(fn func(*Particle), task Task, threadNum int, deques []*Deque, tasksProcessed *int32, cutoff subtreeCutoff) {
+	node := task.Node
 	if node == nil {
 		return
 	}
 
-	// Add child nodes as tasks to deque
-	if node.topLeft != nil {
-		deques[threadNum].PushFront(Task{node.topLeft})
-	}
-	if node.topRight != nil {
-		deques[threadNum].PushFront(Task{node.topRight})
-	}
-	if node.botLeft != nil {
-		deques[threadNum].PushFront(Task{node.botLeft})
-	}
-	if node.botRight != nil {
-		deques[threadNum].PushFront(Task{node.botRight})
-	}
-
-	if node.particle != nil {
-		// Process particle if it exists
-		CalcVelocity(node.particle, root, dt)
-		atomic.AddInt32(tasksProcessed, 1)
-	}
-}
-
-func processPositionSubtree(dt float64, node *BarnesHutNode, threadNum int, deques []*Deque, tasksProcessed *int32) {
-	if node == nil {
+	if cutoff.sequential(node, task.Depth) {
+		// Small enough to run the whole subtree here instead of through the deque.
+		forEachParticleIn(node, fn)
+		atomic.AddInt32(tasksProcessed, node.nParticles)
 		return
 	}
 
 	// Add child nodes as tasks to deque
 	if node.topLeft != nil {
-		deques[threadNum].PushFront(Task{node.topLeft})
+		deques[threadNum].PushFront(Task{node.topLeft, task.Depth + 1})
 	}
 	if node.topRight != nil {
-		deques[threadNum].PushFront(Task{node.topRight})
+		deques[threadNum].PushFront(Task{node.topRight, task.Depth + 1})
 	}
 	if node.botLeft != nil {
-		deques[threadNum].PushFront(Task{node.botLeft})
+		deques[threadNum].PushFront(Task{node.botLeft, task.Depth + 1})
 	}
 	if node.botRight != nil {
-		deques[threadNum].PushFront(Task{node.botRight})
+		deques[threadNum].PushFront(Task{node.botRight, task.Depth + 1})
 	}
 
-	// Update particle position if it exists
 	if node.particle != nil {
-		node.particle.x += node.particle.vx * dt
-		node.particle.y += node.particle.vy * dt
-		node.particle.fx, node.particle.fy = 0.0, 0.0
+		// Process particle if it exists
+		fn(node.particle)
 		atomic.AddInt32(tasksProcessed, 1)
 	}
 }
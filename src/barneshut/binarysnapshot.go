@@ -0,0 +1,334 @@
+package barneshut
+
+import (
+	"bufio"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sort"
+)
+
+/*
+** Binary snapshots, all little-endian:
+**
+**	magic     "BHSNAP" (6 bytes)
+**	version   uint16, BinarySnapshotVersion
+**	flags     uint32, snapshotFloat32 | snapshotDeflate
+**	step      int64
+**	time      float64
+**	n         int64
+**	nparams   uint32, then per parameter in key order: key and value as uint32 length + bytes
+**	payload   raw, or a deflate stream when snapshotDeflate is set:
+**	          id int64[n], then x, y, vx, vy, ax, ay, mass [n] each,
+**	          float64, or float32 when snapshotFloat32 is set
+**
+** The particles are sorted by ID and the columns are stored one after the other (SoA),
+** which is also what compresses best.
+ */
+const BinarySnapshotVersion = 1
+
+const binarySnapshotMagic = "BHSNAP"
+
+const (
+	snapshotFloat32 uint32 = 1 << iota
+	snapshotDeflate
+)
+
+// Limits ReadBinarySnapshot checks the header against, whatever the size of the file.
+const (
+	maxSnapshotParticles   = math.MaxInt32
+	maxSnapshotParams      = 1 << 16
+	maxSnapshotParamLength = 1 << 20
+)
+
+// Deflate expands its input at most about 1032 times.
+const maxDeflateRatio = 1032
+
+// Options of WriteBinarySnapshot.
+type BinarySnapshotOptions struct {
+	Float32 bool // Store the floats as float32, halving the size at the cost of precision.
+	Deflate bool // Compress the payload with compress/flate.
+}
+
+/*
+** A snapshot read back, in columns sorted by ID.
+ */
+type Snapshot struct {
+	Header                     SnapshotHeader
+	Version                    int
+	Options                    BinarySnapshotOptions
+	ID                         []int64
+	X, Y, VX, VY, AX, AY, Mass []float64
+}
+
+func (snapshot *Snapshot) Len() int {
+	return len(snapshot.ID)
+}
+
+// The float columns in file order.
+func (snapshot *Snapshot) columns() []*[]float64 {
+	return []*[]float64{&snapshot.X, &snapshot.Y, &snapshot.VX, &snapshot.VY, &snapshot.AX, &snapshot.AY, &snapshot.Mass}
+}
+
+/*
+** The particles of the snapshot, in ID order.
+ */
+func (snapshot *Snapshot) Particles() []*Particle {
+	particles := make([]*Particle, snapshot.Len())
+	for i := range particles {
+		p := NewParticle(snapshot.X[i], snapshot.Y[i])
+		p.vx, p.vy, p.fx, p.fy = snapshot.VX[i], snapshot.VY[i], snapshot.AX[i], snapshot.AY[i]
+		p.mass, p.id = snapshot.Mass[i], snapshot.ID[i]
+		particles[i] = p
+	}
+	return particles
+}
+
+/*
+** Writes a binary snapshot of the particles, sorted by ID.
+ */
+func WriteBinarySnapshot(w io.Writer, header SnapshotHeader, particles []*Particle, opts BinarySnapshotOptions) error {
+	out := bufio.NewWriter(w)
+	var flags uint32 = 0
+	if opts.Float32 {
+		flags |= snapshotFloat32
+	}
+	if opts.Deflate {
+		flags |= snapshotDeflate
+	}
+
+	buf := []byte(binarySnapshotMagic)
+	buf = binary.LittleEndian.AppendUint16(buf, BinarySnapshotVersion)
+	buf = binary.LittleEndian.AppendUint32(buf, flags)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(header.Step))
+	buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(header.Time))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(particles)))
+	keys := make([]string, 0, len(header.Params))
+	for key := range header.Params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(keys)))
+	for _, key := range keys {
+		for _, s := range []string{key, header.Params[key]} {
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(len(s)))
+			buf = append(buf, s...)
+		}
+	}
+	if _, err := out.Write(buf); err != nil {
+		return err
+	}
+
+	var payload io.Writer = out
+	var compressor *flate.Writer
+	if opts.Deflate {
+		compressor, _ = flate.NewWriter(out, flate.DefaultCompression)
+		payload = compressor
+	}
+	sorted := sortedByID(particles)
+	columns := []func(p *Particle) float64{
+		func(p *Particle) float64 { return p.x }, func(p *Particle) float64 { return p.y },
+		func(p *Particle) float64 { return p.vx }, func(p *Particle) float64 { return p.vy },
+		func(p *Particle) float64 { return p.fx }, func(p *Particle) float64 { return p.fy },
+		func(p *Particle) float64 { return p.mass },
+	}
+	buf = buf[:0]
+	for _, p := range sorted {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(p.id))
+	}
+	for _, column := range columns {
+		for _, p := range sorted {
+			if opts.Float32 {
+				buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(column(p))))
+			} else {
+				buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(column(p)))
+			}
+		}
+	}
+	if _, err := payload.Write(buf); err != nil {
+		return err
+	}
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+/*
+** Writes a binary snapshot to path, replacing the file.
+ */
+func WriteBinarySnapshotFile(path string, header SnapshotHeader, particles []*Particle, opts BinarySnapshotOptions) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := WriteBinarySnapshot(file, header, particles, opts); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+/*
+** Reads a binary snapshot of any version up to BinarySnapshotVersion. The counts and
+** lengths in the header are checked against fixed limits and, if r can seek, against
+** the bytes left in it, so a corrupt header is an error rather than a huge allocation.
+ */
+func ReadBinarySnapshot(r io.Reader) (*Snapshot, error) {
+	left := bytesLeft(r)
+	in := bufio.NewReader(r)
+	magic := make([]byte, len(binarySnapshotMagic))
+	if _, err := io.ReadFull(in, magic); err != nil || string(magic) != binarySnapshotMagic {
+		return nil, errors.New("not a binary snapshot")
+	}
+	var fixed struct {
+		Version uint16
+		Flags   uint32
+		Step    int64
+		Time    float64
+		N       int64
+		NParams uint32
+	}
+	if err := binary.Read(in, binary.LittleEndian, &fixed); err != nil {
+		return nil, fmt.Errorf("reading snapshot header: %w", err)
+	}
+	left -= int64(len(magic) + binary.Size(fixed))
+	if fixed.Version == 0 || fixed.Version > BinarySnapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", fixed.Version)
+	}
+	if fixed.N < 0 || fixed.N > maxSnapshotParticles {
+		return nil, fmt.Errorf("invalid particle count %d", fixed.N)
+	}
+	// Every parameter takes at least its two lengths.
+	if fixed.NParams > maxSnapshotParams || (left >= 0 && int64(fixed.NParams)*8 > left) {
+		return nil, fmt.Errorf("invalid parameter count %d", fixed.NParams)
+	}
+	snapshot := &Snapshot{
+		Header:  SnapshotHeader{Step: int(fixed.Step), Time: fixed.Time, Params: make(map[string]string)},
+		Version: int(fixed.Version),
+		Options: BinarySnapshotOptions{Float32: fixed.Flags&snapshotFloat32 != 0, Deflate: fixed.Flags&snapshotDeflate != 0},
+	}
+	for i := uint32(0); i < fixed.NParams; i++ {
+		var pair [2]string
+		for j := range pair {
+			var length uint32
+			if err := binary.Read(in, binary.LittleEndian, &length); err != nil {
+				return nil, fmt.Errorf("reading snapshot parameters: %w", err)
+			}
+			left -= 4
+			if length > maxSnapshotParamLength || (left >= 0 && int64(length) > left) {
+				return nil, fmt.Errorf("invalid parameter length %d", length)
+			}
+			bytes := make([]byte, length)
+			if _, err := io.ReadFull(in, bytes); err != nil {
+				return nil, fmt.Errorf("reading snapshot parameters: %w", err)
+			}
+			left -= int64(length)
+			pair[j] = string(bytes)
+		}
+		snapshot.Header.Params[pair[0]] = pair[1]
+	}
+
+	n := int(fixed.N)
+	size := 8
+	if snapshot.Options.Float32 {
+		size = 4
+	}
+	payloadSize := int64(n) * int64(8+7*size)
+	if snapshot.Options.Deflate {
+		payloadSize /= maxDeflateRatio
+	}
+	if left >= 0 && payloadSize > left {
+		return nil, fmt.Errorf("invalid particle count %d for %d bytes of payload", n, left)
+	}
+	var payload io.Reader = in
+	if snapshot.Options.Deflate {
+		decompressor := flate.NewReader(in)
+		defer decompressor.Close()
+		payload = decompressor
+	}
+	buf, err := readChunked(payload, int64(8*n))
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot ids: %w", err)
+	}
+	snapshot.ID = make([]int64, n)
+	for i := range snapshot.ID {
+		snapshot.ID[i] = int64(binary.LittleEndian.Uint64(buf[8*i:]))
+	}
+	for _, column := range snapshot.columns() {
+		buf, err := readChunked(payload, int64(size*n))
+		if err != nil {
+			return nil, fmt.Errorf("reading snapshot columns: %w", err)
+		}
+		*column = make([]float64, n)
+		for i := range *column {
+			if snapshot.Options.Float32 {
+				(*column)[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:])))
+			} else {
+				(*column)[i] = math.Float64frombits(binary.LittleEndian.Uint64(buf[8*i:]))
+			}
+		}
+	}
+	return snapshot, nil
+}
+
+// The bytes from the current position of r to its end, or -1 if r cannot seek.
+func bytesLeft(r io.Reader) int64 {
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return -1
+	}
+	pos, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return -1
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if _, err2 := seeker.Seek(pos, io.SeekStart); err != nil || err2 != nil {
+		return -1
+	}
+	return end - pos
+}
+
+/*
+** Reads n bytes, a megabyte at a time, so that a length larger than the data runs
+** into its end before allocating much more than the data holds.
+ */
+func readChunked(r io.Reader, n int64) ([]byte, error) {
+	const chunk = 1 << 20
+	buf := make([]byte, 0, min(n, chunk))
+	for int64(len(buf)) < n {
+		k := int(min(n-int64(len(buf)), chunk))
+		buf = slices.Grow(buf, k)
+		if _, err := io.ReadFull(r, buf[len(buf):len(buf)+k]); err != nil {
+			if err == io.EOF && len(buf) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		buf = buf[:len(buf)+k]
+	}
+	return buf, nil
+}
+
+/*
+** Reads a binary snapshot from path.
+ */
+func ReadBinarySnapshotFile(path string) (*Snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	snapshot, err := ReadBinarySnapshot(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return snapshot, nil
+}
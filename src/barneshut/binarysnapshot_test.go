@@ -0,0 +1,89 @@
+package barneshut
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+/*
+** n particles spread uniformly over a square of side 20000 around the origin, with
+** random velocities and masses and IDs in order, the same for the same seed.
+ */
+func testParticles(n int, seed int64) []*Particle {
+	rng := rand.New(rand.NewSource(seed))
+	particles := make([]*Particle, n)
+	for i := range particles {
+		p := NewParticle(rng.Float64()*20000-10000, rng.Float64()*20000-10000)
+		p.vx, p.vy, p.mass = rng.NormFloat64(), rng.NormFloat64(), 0.5+rng.Float64()
+		p.id = int64(i)
+		particles[i] = p
+	}
+	return particles
+}
+
+func testSnapshot(t *testing.T, opts BinarySnapshotOptions) []byte {
+	t.Helper()
+	particles := testParticles(50, 1)
+	header := SnapshotHeader{Step: 3, Time: 0.3, Params: map[string]string{"dt": "0.1"}}
+	var buf bytes.Buffer
+	if err := WriteBinarySnapshot(&buf, header, particles, opts); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBinarySnapshotRoundTrip(t *testing.T) {
+	for _, opts := range []BinarySnapshotOptions{{}, {Float32: true}, {Deflate: true}, {Float32: true, Deflate: true}} {
+		snapshot, err := ReadBinarySnapshot(bytes.NewReader(testSnapshot(t, opts)))
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		if snapshot.Len() != 50 || snapshot.Header.Step != 3 || snapshot.Header.Params["dt"] != "0.1" || snapshot.Options != opts {
+			t.Errorf("%+v: read back %d particles, header %+v, options %+v", opts, snapshot.Len(), snapshot.Header, snapshot.Options)
+		}
+	}
+}
+
+// A reader that hides the Seek of the reader it wraps.
+type streamReader struct{ io.Reader }
+
+func TestBinarySnapshotCorruptHeader(t *testing.T) {
+	// Offsets in the header: the particle count after magic, version, flags, step and
+	// time, then the parameter count and the length of the first key.
+	const nOffset, nParamsOffset, keyOffset = 28, 36, 40
+	corrupt := []struct {
+		name   string
+		opts   BinarySnapshotOptions
+		offset int
+		value  uint64
+		size   int
+		want   string
+	}{
+		{"negative count", BinarySnapshotOptions{}, nOffset, 1 << 63, 8, "invalid particle count"},
+		{"count overflowing 8*n", BinarySnapshotOptions{}, nOffset, 1 << 61, 8, "invalid particle count"},
+		{"count beyond the file", BinarySnapshotOptions{}, nOffset, 1 << 30, 8, "invalid particle count"},
+		{"count beyond the compressed file", BinarySnapshotOptions{Deflate: true}, nOffset, 1 << 30, 8, "invalid particle count"},
+		{"parameter count", BinarySnapshotOptions{}, nParamsOffset, 1 << 31, 4, "invalid parameter count"},
+		{"parameter length", BinarySnapshotOptions{}, keyOffset, 1<<32 - 1, 4, "invalid parameter length"},
+	}
+	for _, c := range corrupt {
+		data := testSnapshot(t, c.opts)
+		if c.size == 8 {
+			binary.LittleEndian.PutUint64(data[c.offset:], c.value)
+		} else {
+			binary.LittleEndian.PutUint32(data[c.offset:], uint32(c.value))
+		}
+		_, err := ReadBinarySnapshot(bytes.NewReader(data))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got error %v, want %q", c.name, err, c.want)
+		}
+		// Without the size of the data, the reads run into its end instead.
+		if _, err := ReadBinarySnapshot(streamReader{bytes.NewReader(data)}); err == nil {
+			t.Errorf("%s: read a corrupt stream without error", c.name)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package barneshut
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+/*
+** A math/rand source that can be saved and restored: it counts its draws, and is
+** restored by seeding a new source and skipping as many. It produces the same
+** numbers as rand.NewSource(seed).
+ */
+type RandomSource struct {
+	seed  int64
+	draws uint64
+	src   rand.Source64
+}
+
+func NewRandomSource(seed int64) *RandomSource {
+	return &RandomSource{seed: seed, src: rand.NewSource(seed).(rand.Source64)}
+}
+
+/*
+** The source with the given seed after the given number of draws.
+ */
+func RestoreRandomSource(seed int64, draws uint64) *RandomSource {
+	source := NewRandomSource(seed)
+	for source.draws < draws {
+		source.Uint64()
+	}
+	return source
+}
+
+func (source *RandomSource) Int63() int64 {
+	source.draws++
+	return source.src.Int63()
+}
+
+func (source *RandomSource) Uint64() uint64 {
+	source.draws++
+	return source.src.Uint64()
+}
+
+func (source *RandomSource) Seed(seed int64) {
+	source.seed, source.draws = seed, 0
+	source.src.Seed(seed)
+}
+
+func (source *RandomSource) State() (seed int64, draws uint64) {
+	return source.seed, source.draws
+}
+
+// Parameters of a checkpoint holding the random source.
+const (
+	checkpointSeed  = "rng.seed"
+	checkpointDraws = "rng.draws"
+)
+
+/*
+** Writes a checkpoint: a binary snapshot at full precision whose parameters also hold
+** the state of the random source. The file is replaced atomically, so a crash leaves
+** either the previous checkpoint or the new one.
+ */
+func WriteCheckpoint(path string, header SnapshotHeader, particles []*Particle, rng *RandomSource) error {
+	params := make(map[string]string, len(header.Params)+2)
+	for key, value := range header.Params {
+		params[key] = value
+	}
+	seed, draws := rng.State()
+	params[checkpointSeed] = strconv.FormatInt(seed, 10)
+	params[checkpointDraws] = strconv.FormatUint(draws, 10)
+	header.Params = params
+
+	return WriteFileAtomic(path, func(w io.Writer) error {
+		return WriteBinarySnapshot(w, header, particles, BinarySnapshotOptions{Deflate: true})
+	})
+}
+
+/*
+** Reads a checkpoint written by WriteCheckpoint and restores its random source.
+ */
+func ReadCheckpoint(path string) (*Snapshot, *RandomSource, error) {
+	snapshot, err := ReadBinarySnapshotFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	seed, err := strconv.ParseInt(snapshot.Header.Params[checkpointSeed], 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: not a checkpoint, invalid %s: %w", path, checkpointSeed, err)
+	}
+	draws, err := strconv.ParseUint(snapshot.Header.Params[checkpointDraws], 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: not a checkpoint, invalid %s: %w", path, checkpointDraws, err)
+	}
+	delete(snapshot.Header.Params, checkpointSeed)
+	delete(snapshot.Header.Params, checkpointDraws)
+	return snapshot, RestoreRandomSource(seed, draws), nil
+}
+
+/*
+** Writes a file through a temporary file in the same directory, synced and then
+** renamed over path.
+ */
+func WriteFileAtomic(path string, write func(w io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := write(file); err != nil {
+		return fail(err)
+	}
+	if err := file.Sync(); err != nil {
+		return fail(err)
+	}
+	// CreateTemp makes the file private, make it readable as os.Create would.
+	if err := file.Chmod(0644); err != nil {
+		return fail(err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package barneshut
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Space-filling curves ordering the particles of a distributed run.
+const (
+	CurveMorton  = "morton"  // Z-order, the bit interleaving of the coordinates.
+	CurveHilbert = "hilbert" // Hilbert curve, whose key ranges are more compact domains.
+)
+
+func validCurve(curve string) error {
+	switch curve {
+	case CurveMorton, CurveHilbert, "":
+		return nil
+	}
+	return fmt.Errorf("unknown curve %q", curve)
+}
+
+/*
+** The domain decomposition of a distributed run: a square mapped onto a space-filling
+** curve and cut into one key range per rank. Rank r owns the keys in
+** [Splitters[r-1], Splitters[r]), the first rank from 0 and the last up to the end.
+** Particles outside the square are clamped onto its edge.
+ */
+type domainMap struct {
+	Curve      string
+	MinX, MinY float64
+	Size       float64
+	Splitters  []uint64 // NumRanks-1 increasing keys.
+}
+
+func (domains *domainMap) key(x, y float64) uint64 {
+	scale := float64(math.MaxUint32) / domains.Size
+	ix := uint32(min(max((x-domains.MinX)*scale, 0), math.MaxUint32))
+	iy := uint32(min(max((y-domains.MinY)*scale, 0), math.MaxUint32))
+	if domains.Curve == CurveHilbert {
+		return hilbertKey(ix, iy)
+	}
+	return mortonKey(ix, iy)
+}
+
+func (domains *domainMap) owner(x, y float64) int {
+	key := domains.key(x, y)
+	return sort.Search(len(domains.Splitters), func(i int) bool { return domains.Splitters[i] > key })
+}
+
+/*
+** Position along the Hilbert curve of order 32 through the cell (x, y).
+ */
+func hilbertKey(x, y uint32) uint64 {
+	var key uint64 = 0
+	for s := uint32(1) << 31; s > 0; s >>= 1 {
+		var rx, ry uint32
+		if x&s != 0 {
+			rx = 1
+		}
+		if y&s != 0 {
+			ry = 1
+		}
+		key += uint64(s) * uint64(s) * uint64((3*rx)^ry)
+		// Rotate the quadrant so the curve continues in the right orientation.
+		if ry == 0 {
+			if rx == 1 {
+				x, y = ^x, ^y
+			}
+			x, y = y, x
+		}
+	}
+	return key
+}
+
+// The cost of a particle at a position, sent by the ranks for rebalancing.
+type costSample struct {
+	X, Y float64
+	Cost int64
+}
+
+/*
+** Decomposes the samples into numRanks key ranges of about equal total cost, on the
+** smallest square holding bounds.
+ */
+func balanceDomains(curve string, bounds rankBounds, samples []costSample, numRanks int) *domainMap {
+	size := max(bounds.MaxX-bounds.MinX, bounds.MaxY-bounds.MinY)
+	if size == 0 || bounds.Empty {
+		size = 1
+	}
+	domains := &domainMap{Curve: curve, MinX: bounds.MinX, MinY: bounds.MinY, Size: size * (1 + 1e-9)}
+
+	keys := make([]uint64, len(samples))
+	order := make([]int, len(samples))
+	var total int64 = 0
+	for i, sample := range samples {
+		keys[i] = domains.key(sample.X, sample.Y)
+		order[i] = i
+		total += sample.Cost
+	}
+	sort.Slice(order, func(a, b int) bool { return keys[order[a]] < keys[order[b]] })
+
+	// Cut before the first sample past each multiple of total/numRanks.
+	var cumulative int64 = 0
+	for _, i := range order {
+		for len(domains.Splitters) < numRanks-1 && cumulative*int64(numRanks) >= total*int64(len(domains.Splitters)+1) {
+			domains.Splitters = append(domains.Splitters, keys[i])
+		}
+		cumulative += samples[i].Cost
+	}
+	for len(domains.Splitters) < numRanks-1 {
+		domains.Splitters = append(domains.Splitters, math.MaxUint64)
+	}
+	return domains
+}
+
+func boundsUnion(all []rankBounds) rankBounds {
+	union := rankBounds{Empty: true}
+	for _, bounds := range all {
+		if bounds.Empty {
+			continue
+		}
+		if union.Empty {
+			union = bounds
+			continue
+		}
+		union.MinX, union.MaxX = min(union.MinX, bounds.MinX), max(union.MaxX, bounds.MaxX)
+		union.MinY, union.MaxY = min(union.MinY, bounds.MinY), max(union.MaxY, bounds.MaxY)
+	}
+	return union
+}
+
+func costSamples(particles []*Particle) []costSample {
+	samples := make([]costSample, len(particles))
+	for i, p := range particles {
+		samples[i] = costSample{X: p.x, Y: p.y, Cost: particleCost(p)}
+	}
+	return samples
+}
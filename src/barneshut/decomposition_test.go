@@ -0,0 +1,71 @@
+package barneshut
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestInProcessMatchesSingleProcess(t *testing.T) {
+	const n, steps = 500, 10
+	want := testParticles(n, 7)
+	runSingle(want, steps, 1)
+	for numRanks := 1; numRanks <= 4; numRanks++ {
+		for _, curve := range []string{CurveMorton, CurveHilbert} {
+			t.Run(fmt.Sprintf("%d ranks %s", numRanks, curve), func(t *testing.T) {
+				got := testParticles(n, 7)
+				config := DistributedConfig{Steps: steps, Dt: 1, Curve: curve, RebalanceEvery: 2}
+				if completed, err := RunInProcess(context.Background(), numRanks, got, config); err != nil || completed != steps {
+					t.Fatalf("completed %d of %d steps: %v", completed, steps, err)
+				}
+				compareRuns(t, want, got)
+			})
+		}
+	}
+}
+
+/*
+** Particles fast enough to cross domains every step, with the domains recomputed every
+** step, so most steps migrate particles between ranks. Every particle must come back
+** once, with its ID, where a single process moves it.
+ */
+func TestInProcessMigration(t *testing.T) {
+	const n, steps = 500, 30
+	fast := func() []*Particle {
+		particles := testParticles(n, 3)
+		for _, p := range particles {
+			p.vx, p.vy = 300*p.vx, 300*p.vy
+		}
+		return particles
+	}
+	want := fast()
+	runSingle(want, steps, 1)
+	for numRanks := 2; numRanks <= 4; numRanks++ {
+		got := fast()
+		initial := domainOwners(got, numRanks)
+		config := DistributedConfig{Steps: steps, Dt: 1, Curve: CurveHilbert, RebalanceEvery: 1}
+		if completed, err := RunInProcess(context.Background(), numRanks, got, config); err != nil || completed != steps {
+			t.Fatalf("%d ranks: completed %d of %d steps: %v", numRanks, completed, steps, err)
+		}
+		moved := 0
+		for i, owner := range domainOwners(got, numRanks) {
+			if owner != initial[i] {
+				moved++
+			}
+		}
+		if moved == 0 {
+			t.Errorf("%d ranks: no particle changed rank", numRanks)
+		}
+		compareRuns(t, want, got)
+	}
+}
+
+// The rank of each particle after a decomposition of equal counts.
+func domainOwners(particles []*Particle, numRanks int) []int {
+	domains := balanceDomains(CurveHilbert, particleBounds(particles), costSamples(particles), numRanks)
+	owners := make([]int, len(particles))
+	for i, p := range particles {
+		owners[i] = domains.owner(p.x, p.y)
+	}
+	return owners
+}
@@ -0,0 +1,539 @@
+package barneshut
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+** Distributed simulation: the particles are split between ranks, separate processes
+** connected over TCP to a coordinator. Each rank owns the particles of one domain, a
+** key range of a space-filling curve (see domainMap), and only ever builds a tree of
+** its own particles plus what the others send it.
+**
+** A step is four exchanges through the coordinator, which also acts as the barrier:
+**  1. Every rank reports the bounding box of its particles, and every RebalanceEvery
+**     steps the force-walk cost of each of them. The coordinator answers with the
+**     domains, recomputed from the costs on a rebalancing step, or tells the ranks to stop.
+**  2. Every rank sends the particles that left its domain to their new owners.
+**  3. Every rank sends the bounding box of its particles after the migration, and the
+**     coordinator sends all the boxes back.
+**  4. Every rank sends each other rank its locally essential tree (LET): the nodes of
+**     its own tree that pass the opening criterion for every point of the receiver's
+**     box, as COM summaries, and the particles of the leaves it had to open, which are
+**     the boundary particles near the receiver.
+** The rank then adds what it received to its tree as source-only particles and runs
+** the step with its own scheduler.
+ */
+
+// Settings of a distributed run, sent by the coordinator to every rank.
+type DistributedConfig struct {
+	NumRanks       int
+	Steps          int
+	Dt             float64
+	Scheduler      SchedulerOptions // Scheduler of each rank.
+	Curve          string           // One of the Curve* constants, Morton by default.
+	RebalanceEvery int              // Steps between rebalancings of the domains, 0 for never.
+}
+
+// A particle sent to or from a rank. ID is its position in the coordinator's slice.
+type particleRecord struct {
+	ID                         int64
+	X, Y, VX, VY, AX, AY, Mass float64
+	Interactions               int32
+}
+
+// A source of force in a LET: a boundary particle or the COM of a remote node.
+type letSource struct {
+	X, Y, Mass float64
+}
+
+type rankBounds struct {
+	MinX, MaxX, MinY, MaxY float64
+	Empty                  bool
+}
+
+// Coordinator -> rank, once.
+type rankSetup struct {
+	Rank      int
+	Config    DistributedConfig
+	Particles []particleRecord
+}
+
+// Rank -> coordinator, at the start of each step.
+type rankReport struct {
+	Bounds rankBounds
+	Costs  []costSample // Only on rebalancing steps.
+}
+
+// Coordinator -> rank, the answer to rankReport.
+type rankStep struct {
+	Stop    bool
+	Domains *domainMap
+}
+
+// Rank -> coordinator, the particles or LET for each rank, indexed by rank.
+type rankExport struct {
+	Particles [][]particleRecord
+	Sources   [][]letSource
+}
+
+// Coordinator -> rank, what the other ranks sent it, in rank order.
+type rankImport struct {
+	Particles []particleRecord
+	Sources   []letSource
+}
+
+// Coordinator -> rank, the bounding boxes of every rank after the migration.
+type rankAllBounds struct {
+	Bounds []rankBounds
+}
+
+// Rank -> coordinator, after a stop.
+type rankResult struct {
+	Particles []particleRecord
+}
+
+// One end of the connection between the coordinator and a rank.
+type rankConn struct {
+	conn net.Conn
+	enc  *gob.Encoder
+	dec  *gob.Decoder
+}
+
+func newRankConn(conn net.Conn) *rankConn {
+	return &rankConn{conn: conn, enc: gob.NewEncoder(conn), dec: gob.NewDecoder(conn)}
+}
+
+/*
+** Accepts numRanks connections on the listener, in the order the ranks connect.
+ */
+func AcceptRanks(ctx context.Context, listener net.Listener, numRanks int) ([]net.Conn, error) {
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+
+	conns := make([]net.Conn, 0, numRanks)
+	for len(conns) < numRanks {
+		conn, err := listener.Accept()
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return nil, fmt.Errorf("accepting rank %d of %d: %w", len(conns), numRanks, err)
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+/*
+** Dials the coordinator, retrying until it is listening or ctx is done.
+ */
+func DialCoordinator(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("dialing coordinator %s: %w", addr, err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+/*
+** Runs the whole distributed simulation in this process, with numRanks ranks talking
+** to the coordinator over in-memory connections. Used to test the decomposition and
+** the protocol on one machine.
+ */
+func RunInProcess(ctx context.Context, numRanks int, particles []*Particle, config DistributedConfig) (int, error) {
+	conns := make([]net.Conn, numRanks)
+	errs := make([]error, numRanks)
+	var wg sync.WaitGroup
+	for r := range conns {
+		coordinatorEnd, rankEnd := net.Pipe()
+		conns[r] = coordinatorEnd
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := RunRank(context.Background(), rankEnd); err != nil {
+				errs[r] = fmt.Errorf("rank %d: %w", r, err)
+			}
+		}()
+	}
+	steps, err := RunCoordinator(ctx, conns, particles, config)
+	wg.Wait()
+	if err != nil && !errors.Is(err, ctx.Err()) {
+		return steps, errors.Join(append([]error{err}, errs...)...)
+	}
+	return steps, err
+}
+
+/*
+** Runs the coordinator over one connection per rank: decomposes the particles into
+** key ranges of equal counts, runs the steps and copies the final state back into the
+** particles. Once ctx is done the ranks stop after the current step.
+** Returns the number of completed steps, and closes the connections.
+ */
+func RunCoordinator(ctx context.Context, conns []net.Conn, particles []*Particle, config DistributedConfig) (int, error) {
+	if err := validCurve(config.Curve); err != nil {
+		return 0, err
+	}
+	config.NumRanks = len(conns)
+	ranks := make([]*rankConn, len(conns))
+	for r, conn := range conns {
+		ranks[r] = newRankConn(conn)
+		defer conn.Close()
+	}
+	// A rank that fails closes its connection; close the rest so no one waits forever.
+	fail := func(err error) (int, error) {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return 0, err
+	}
+
+	// Every particle costs the same until the first step is measured.
+	setups := make([]rankSetup, len(ranks))
+	domains := balanceDomains(config.Curve, particleBounds(particles), costSamples(particles), len(ranks))
+	for i, p := range particles {
+		r := domains.owner(p.x, p.y)
+		setups[r].Particles = append(setups[r].Particles, newParticleRecord(int64(i), p))
+	}
+	if err := gatherRanks(ranks, func(r int, rank *rankConn) error {
+		setups[r].Rank, setups[r].Config = r, config
+		return rank.enc.Encode(setups[r])
+	}); err != nil {
+		return fail(err)
+	}
+
+	steps := 0
+	for {
+		reports := make([]rankReport, len(ranks))
+		if err := gatherRanks(ranks, func(r int, rank *rankConn) error {
+			return rank.dec.Decode(&reports[r])
+		}); err != nil {
+			return fail(err)
+		}
+		stop := steps == config.Steps || ctx.Err() != nil
+		if rebalancing(config, steps) && !stop {
+			bounds := make([]rankBounds, len(ranks))
+			var samples []costSample
+			for r, report := range reports {
+				bounds[r] = report.Bounds
+				samples = append(samples, report.Costs...)
+			}
+			domains = balanceDomains(config.Curve, boundsUnion(bounds), samples, len(ranks))
+		}
+		if err := gatherRanks(ranks, func(r int, rank *rankConn) error {
+			return rank.enc.Encode(rankStep{Stop: stop, Domains: domains})
+		}); err != nil {
+			return fail(err)
+		}
+		if stop {
+			break
+		}
+
+		// Migration.
+		if err := routeExports(ranks); err != nil {
+			return fail(err)
+		}
+		bounds := make([]rankBounds, len(ranks))
+		if err := gatherRanks(ranks, func(r int, rank *rankConn) error {
+			return rank.dec.Decode(&bounds[r])
+		}); err != nil {
+			return fail(err)
+		}
+		if err := gatherRanks(ranks, func(r int, rank *rankConn) error {
+			return rank.enc.Encode(rankAllBounds{Bounds: bounds})
+		}); err != nil {
+			return fail(err)
+		}
+		// LETs.
+		if err := routeExports(ranks); err != nil {
+			return fail(err)
+		}
+		steps++
+	}
+
+	results := make([]rankResult, len(ranks))
+	if err := gatherRanks(ranks, func(r int, rank *rankConn) error {
+		return rank.dec.Decode(&results[r])
+	}); err != nil {
+		return fail(err)
+	}
+	// Every particle comes back from exactly one rank, whatever the migrations did.
+	returned := make([]bool, len(particles))
+	for _, result := range results {
+		for _, record := range result.Particles {
+			if record.ID < 0 || record.ID >= int64(len(particles)) || returned[record.ID] {
+				return steps, fmt.Errorf("particle %d returned twice or unknown", record.ID)
+			}
+			returned[record.ID] = true
+			record.store(particles[record.ID])
+		}
+	}
+	if missing := slices.Index(returned, false); missing >= 0 {
+		return steps, fmt.Errorf("particle %d was lost", missing)
+	}
+	if steps < config.Steps {
+		return steps, ctx.Err()
+	}
+	return steps, nil
+}
+
+// Whether the ranks report their costs and the domains are recomputed at this step.
+func rebalancing(config DistributedConfig, step int) bool {
+	return config.RebalanceEvery > 0 && step > 0 && step%config.RebalanceEvery == 0
+}
+
+// Receives a rankExport from every rank and sends each rank what was addressed to it.
+func routeExports(ranks []*rankConn) error {
+	exports := make([]rankExport, len(ranks))
+	if err := gatherRanks(ranks, func(r int, rank *rankConn) error {
+		return rank.dec.Decode(&exports[r])
+	}); err != nil {
+		return err
+	}
+	return gatherRanks(ranks, func(r int, rank *rankConn) error {
+		var imported rankImport
+		for from, export := range exports {
+			if from == r {
+				continue
+			}
+			if r < len(export.Particles) {
+				imported.Particles = append(imported.Particles, export.Particles[r]...)
+			}
+			if r < len(export.Sources) {
+				imported.Sources = append(imported.Sources, export.Sources[r]...)
+			}
+		}
+		return rank.enc.Encode(imported)
+	})
+}
+
+// Runs fn for every rank concurrently, returning the first error.
+func gatherRanks(ranks []*rankConn, fn func(r int, rank *rankConn) error) error {
+	errs := make([]error, len(ranks))
+	var wg sync.WaitGroup
+	for r, rank := range ranks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(r, rank); err != nil {
+				errs[r] = fmt.Errorf("rank %d: %w", r, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func newParticleRecord(id int64, p *Particle) particleRecord {
+	return particleRecord{ID: id, X: p.x, Y: p.y, VX: p.vx, VY: p.vy, AX: p.fx, AY: p.fy, Mass: p.mass, Interactions: p.interactions}
+}
+
+func (record particleRecord) store(p *Particle) {
+	p.x, p.y, p.vx, p.vy, p.fx, p.fy = record.X, record.Y, record.VX, record.VY, record.AX, record.AY
+	p.mass, p.interactions = record.Mass, record.Interactions
+}
+
+/*
+** The state of one rank: its particles and their IDs, in the same order.
+ */
+type rank struct {
+	coordinator *rankConn
+	num         int
+	config      DistributedConfig
+	particles   []*Particle
+	ids         []int64
+}
+
+func (rank *rank) add(record particleRecord) {
+	p := new(Particle)
+	record.store(p)
+	rank.particles = append(rank.particles, p)
+	rank.ids = append(rank.ids, record.ID)
+}
+
+/*
+** Runs one rank over its connection to the coordinator until the coordinator stops
+** it. Returns the statistics of the rank's scheduler.
+ */
+func RunRank(ctx context.Context, conn net.Conn) (Stats, error) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	coordinator := newRankConn(conn)
+
+	var setup rankSetup
+	if err := coordinator.dec.Decode(&setup); err != nil {
+		return Stats{}, fmt.Errorf("receiving setup: %w", err)
+	}
+	sched, err := NewScheduler(setup.Config.Scheduler)
+	if err != nil {
+		return Stats{}, err
+	}
+	stats := NewStats(sched)
+	state := &rank{coordinator: coordinator, num: setup.Rank, config: setup.Config}
+	for _, record := range setup.Particles {
+		state.add(record)
+	}
+
+	for steps := 0; ; steps++ {
+		report := rankReport{Bounds: particleBounds(state.particles)}
+		if rebalancing(state.config, steps) {
+			report.Costs = costSamples(state.particles)
+		}
+		if err := coordinator.enc.Encode(report); err != nil {
+			return stats, fmt.Errorf("sending report: %w", err)
+		}
+		var step rankStep
+		if err := coordinator.dec.Decode(&step); err != nil {
+			return stats, fmt.Errorf("receiving step: %w", err)
+		}
+		if step.Stop {
+			break
+		}
+
+		if err := state.migrate(step.Domains); err != nil {
+			return stats, err
+		}
+		sources, err := state.exchangeEssential(sched)
+		if err != nil {
+			return stats, err
+		}
+
+		root := newTree(state.particles)
+		for _, source := range sources {
+			InsertParticle(root, &Particle{x: source.X, y: source.Y, mass: source.Mass, ghost: true})
+		}
+		stepStats, err := RunSimulationContext(context.Background(), root, sched, state.config.Dt, len(state.particles)+len(sources))
+		stats.Add(stepStats)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	var result rankResult
+	for i, p := range state.particles {
+		result.Particles = append(result.Particles, newParticleRecord(state.ids[i], p))
+	}
+	if err := coordinator.enc.Encode(result); err != nil {
+		return stats, fmt.Errorf("sending result: %w", err)
+	}
+	return stats, nil
+}
+
+// Sends the particles outside the rank's domain to their owners and adds the ones it receives.
+func (rank *rank) migrate(domains *domainMap) error {
+	export := rankExport{Particles: make([][]particleRecord, rank.config.NumRanks)}
+	kept := 0
+	for i, p := range rank.particles {
+		if owner := domains.owner(p.x, p.y); owner != rank.num {
+			export.Particles[owner] = append(export.Particles[owner], newParticleRecord(rank.ids[i], p))
+			continue
+		}
+		rank.particles[kept], rank.ids[kept] = p, rank.ids[i]
+		kept++
+	}
+	rank.particles, rank.ids = rank.particles[:kept], rank.ids[:kept]
+
+	if err := rank.coordinator.enc.Encode(export); err != nil {
+		return fmt.Errorf("sending migrants: %w", err)
+	}
+	var imported rankImport
+	if err := rank.coordinator.dec.Decode(&imported); err != nil {
+		return fmt.Errorf("receiving migrants: %w", err)
+	}
+	for _, record := range imported.Particles {
+		rank.add(record)
+	}
+	return nil
+}
+
+// Exchanges the bounding boxes and then the LETs, returning the sources received.
+func (rank *rank) exchangeEssential(sched Scheduler) ([]letSource, error) {
+	if err := rank.coordinator.enc.Encode(particleBounds(rank.particles)); err != nil {
+		return nil, fmt.Errorf("sending bounds: %w", err)
+	}
+	var all rankAllBounds
+	if err := rank.coordinator.dec.Decode(&all); err != nil {
+		return nil, fmt.Errorf("receiving bounds: %w", err)
+	}
+
+	local := newTree(rank.particles)
+	sched.CenterOfMass(context.Background(), local, make([]WorkerCounters, sched.NumThreads()))
+	export := rankExport{Sources: make([][]letSource, len(all.Bounds))}
+	for r, bounds := range all.Bounds {
+		if r != rank.num && !bounds.Empty {
+			export.Sources[r] = appendEssential(local, bounds, nil)
+		}
+	}
+	if err := rank.coordinator.enc.Encode(export); err != nil {
+		return nil, fmt.Errorf("sending LET: %w", err)
+	}
+	var imported rankImport
+	if err := rank.coordinator.dec.Decode(&imported); err != nil {
+		return nil, fmt.Errorf("receiving LETs: %w", err)
+	}
+	return imported.Sources, nil
+}
+
+func newTree(particles []*Particle) *BarnesHutNode {
+	root := CreateNode(float64(math.MinInt64), float64(math.MaxInt64), float64(math.MinInt64), float64(math.MaxInt64), nil)
+	for _, particle := range particles {
+		InsertParticle(root, particle)
+	}
+	return root
+}
+
+func particleBounds(particles []*Particle) rankBounds {
+	if len(particles) == 0 {
+		return rankBounds{Empty: true}
+	}
+	bounds := rankBounds{MinX: particles[0].x, MaxX: particles[0].x, MinY: particles[0].y, MaxY: particles[0].y}
+	for _, p := range particles[1:] {
+		bounds.MinX, bounds.MaxX = min(bounds.MinX, p.x), max(bounds.MaxX, p.x)
+		bounds.MinY, bounds.MaxY = min(bounds.MinY, p.y), max(bounds.MaxY, p.y)
+	}
+	return bounds
+}
+
+/*
+** Appends the LET of the tree below node for a receiver whose particles lie in box.
+** A node is summarised by its COM when s/D < THETA for D the distance from the COM to
+** the closest point of the box, so every particle of the receiver would have accepted
+** it too. Leaves are sent as they are.
+ */
+func appendEssential(node *BarnesHutNode, box rankBounds, sources []letSource) []letSource {
+	if node == nil || node.totalMass == 0 {
+		return sources
+	}
+	if node.particle != nil {
+		return append(sources, letSource{X: node.particle.x, Y: node.particle.y, Mass: node.particle.mass})
+	}
+	dx := max(box.MinX-node.comX, 0, node.comX-box.MaxX)
+	dy := max(box.MinY-node.comY, 0, node.comY-box.MaxY)
+	D := math.Sqrt(dx*dx + dy*dy + SOFTENING)
+	if (node.rightX-node.leftX)/D < THETA {
+		return append(sources, letSource{X: node.comX, Y: node.comY, Mass: node.totalMass})
+	}
+	for _, child := range node.quadrants() {
+		sources = appendEssential(child, box, sources)
+	}
+	return sources
+}
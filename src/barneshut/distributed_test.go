@@ -0,0 +1,81 @@
+package barneshut
+
+import (
+	"context"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+// Runs the particles for steps time-steps in one process, as the tree layout of main.
+func runSingle(particles []*Particle, steps int, dt float64) {
+	sched, _ := NewScheduler(SchedulerOptions{Name: SchedulerSequential, NumThreads: 1})
+	root := newTree(particles)
+	for step := 0; step < steps; step++ {
+		RunSimulation(root, sched, dt, len(particles))
+		newRoot := newTree(nil)
+		RecreateWithNewPos(root, newRoot)
+		root = newRoot
+	}
+}
+
+/*
+** Checks that the particles of a distributed run end where those of a single process
+** do. The ranks walk the same tree as one process, but a node whose children are
+** split between ranks sums their masses in another order, so the positions may differ
+** in the last bits.
+ */
+func compareRuns(t *testing.T, want, got []*Particle) {
+	t.Helper()
+	const tolerance = 1e-6
+	for i := range want {
+		w, g := want[i], got[i]
+		if g.id != w.id || math.Abs(g.x-w.x) > tolerance || math.Abs(g.y-w.y) > tolerance ||
+			math.Abs(g.vx-w.vx) > tolerance || math.Abs(g.vy-w.vy) > tolerance {
+			t.Fatalf("particle %d: got id %d at (%v, %v) moving (%v, %v), want id %d at (%v, %v) moving (%v, %v)",
+				i, g.id, g.x, g.y, g.vx, g.vy, w.id, w.x, w.y, w.vx, w.vy)
+		}
+	}
+}
+
+func TestTCPRanksMatchSingleProcess(t *testing.T) {
+	const n, numRanks, steps = 400, 3, 8
+	want := testParticles(n, 11)
+	runSingle(want, steps, 1)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	rankErrs := make(chan error, numRanks)
+	for r := 0; r < numRanks; r++ {
+		go func() {
+			conn, err := DialCoordinator(ctx, listener.Addr().String())
+			if err == nil {
+				_, err = RunRank(ctx, conn)
+			}
+			rankErrs <- err
+		}()
+	}
+	conns, err := AcceptRanks(ctx, listener, numRanks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := testParticles(n, 11)
+	config := DistributedConfig{Steps: steps, Dt: 1, Scheduler: SchedulerOptions{Name: SchedulerSequential, NumThreads: 1}, RebalanceEvery: 3}
+	completed, err := RunCoordinator(ctx, conns, got, config)
+	for r := 0; r < numRanks; r++ {
+		if err := <-rankErrs; err != nil {
+			t.Errorf("rank: %v", err)
+		}
+	}
+	if err != nil || completed != steps {
+		t.Fatalf("completed %d of %d steps: %v", completed, steps, err)
+	}
+	compareRuns(t, want, got)
+}
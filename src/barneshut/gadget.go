@@ -0,0 +1,465 @@
+package barneshut
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+)
+
+/*
+** GADGET snapshots, the format of GADGET-2 and many cosmology codes. The file is a
+** sequence of Fortran records, each block framed by its size in bytes as an int32
+** before and after it:
+**
+**	HEAD  GadgetHeader, 256 bytes
+**	POS   float32[N][3], or float64 in double precision files
+**	VEL   float32[N][3], or float64
+**	ID    uint32[N], or uint64 with long IDs
+**	MASS  float32, or float64, for the types whose mass is 0 in the mass table
+**
+** Format 2 puts a 16-byte record before every block: its 4-character name and the size
+** of the block plus 8, so blocks can be found by name and unknown ones skipped. The
+** particles are ordered by type, 0 to 5, and the byte order is the writer's.
+**
+** Our particles are 2D: x and y are kept and z dropped on import, and z is 0 on export.
+** Particles that land on the same x and y, as the columns of a 3D lattice do, are merged
+** into one with their total mass and momentum and the ID of the first of them.
+ */
+
+// G in the default GADGET units: kpc/h, km/s and 1e10 Msun/h.
+const GadgetG = 43007.1
+
+/*
+** The header block of a GADGET snapshot.
+ */
+type GadgetHeader struct {
+	NPart               [6]uint32  // Particles of each type in this file.
+	MassTable           [6]float64 // Mass of the particles of each type, 0 if in the MASS block.
+	Time                float64    // Time, or the scale factor in cosmological runs.
+	Redshift            float64
+	FlagSfr             int32
+	FlagFeedback        int32
+	NPartTotal          [6]uint32 // Particles of each type in all files, low 32 bits.
+	FlagCooling         int32
+	NumFiles            int32
+	BoxSize             float64
+	Omega0              float64
+	OmegaLambda         float64
+	HubbleParam         float64
+	FlagStellarAge      int32
+	FlagMetals          int32
+	NPartTotalHighWord  [6]uint32
+	FlagEntropyInsteadU int32
+	Fill                [60]byte
+}
+
+/*
+** The particles of all types in the file. Loading merges those sharing an x and y, so
+** fewer particles than this are returned when a lattice or a disk seen edge-on is merged.
+ */
+func (header *GadgetHeader) NumParticles() int {
+	n := 0
+	for _, count := range header.NPart {
+		n += int(count)
+	}
+	return n
+}
+
+/*
+** Sizes of the GADGET units in simulation units, where G = 1: a GADGET length of 1 is
+** Length in the simulation, and so on. 0 means 1 for Length and Velocity, and for Mass
+** the value that keeps the accelerations, GadgetG * Length * Velocity², so an imported
+** system evolves as it would in GADGET.
+ */
+type GadgetUnits struct {
+	Length   float64
+	Velocity float64
+	Mass     float64
+}
+
+func (units GadgetUnits) scales() (length, velocity, mass float64) {
+	length, velocity, mass = units.Length, units.Velocity, units.Mass
+	if length == 0 {
+		length = 1
+	}
+	if velocity == 0 {
+		velocity = 1
+	}
+	if mass == 0 {
+		mass = GadgetG * length * velocity * velocity
+	}
+	return length, velocity, mass
+}
+
+// Options of WriteGadget.
+type GadgetOptions struct {
+	Format int  // 1 or 2, 2 if 0.
+	Double bool // Write POS, VEL and MASS as float64, as GADGET built with DOUBLEPRECISION.
+	Units  GadgetUnits
+}
+
+/*
+** Loads the particles of a GADGET format 1 or 2 snapshot of either byte order, all
+** types in type order. Positions, velocities and masses are converted to simulation
+** units and the IDs are kept. Velocities are taken as stored, which in cosmological
+** runs is the peculiar velocity over the square root of the scale factor.
+ */
+func LoadGadget(r io.Reader, units GadgetUnits) ([]*Particle, *GadgetHeader, error) {
+	loader := particleLoader{ids: make(map[int64]int), positions: make(map[[2]float64]int)}
+	header, err := loader.loadGadget(r, units)
+	if err != nil {
+		return nil, nil, err
+	}
+	return loader.particles, header, nil
+}
+
+func LoadGadgetFile(path string, units GadgetUnits) ([]*Particle, *GadgetHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	particles, header, err := LoadGadget(file, units)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return particles, header, nil
+}
+
+// Reads the records of a GADGET file.
+type gadgetReader struct {
+	in     *bufio.Reader
+	order  binary.ByteOrder
+	format int
+}
+
+// Reads the size framing a record, in the file's byte order.
+func (g *gadgetReader) size() (int, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(g.in, buf[:]); err != nil {
+		return 0, err
+	}
+	return int(int32(g.order.Uint32(buf[:]))), nil
+}
+
+/*
+** Reads one record of at most limit bytes. The limit comes from the header, so the
+** record is read in chunks: a corrupt size runs into the end of the file after
+** allocating about as much as the file holds rather than the size.
+ */
+func (g *gadgetReader) record(limit int) ([]byte, error) {
+	size, err := g.size()
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 || size > limit {
+		return nil, fmt.Errorf("invalid record size %d, at most %d expected", size, limit)
+	}
+	data, err := readChunked(g.in, int64(size))
+	if err != nil {
+		return nil, fmt.Errorf("truncated record: %w", err)
+	}
+	if end, err := g.size(); err != nil || end != size {
+		return nil, fmt.Errorf("record of %d bytes not closed by its size", size)
+	}
+	return data, nil
+}
+
+// Skips one record without reading it into memory.
+func (g *gadgetReader) skip() error {
+	size, err := g.size()
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		return fmt.Errorf("invalid record size %d", size)
+	}
+	if _, err := g.in.Discard(size); err != nil {
+		return fmt.Errorf("truncated record: %w", err)
+	}
+	if end, err := g.size(); err != nil || end != size {
+		return fmt.Errorf("record of %d bytes not closed by its size", size)
+	}
+	return nil
+}
+
+/*
+** Reads the next block of at most limit bytes, with its name in format 2 files. A
+** format 2 block whose name is not wanted is skipped, and returned without data.
+ */
+func (g *gadgetReader) block(wanted []string, limit int) (string, []byte, error) {
+	name := ""
+	if g.format == 2 {
+		label, err := g.record(8)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(label) != 8 {
+			return "", nil, fmt.Errorf("invalid block label of %d bytes", len(label))
+		}
+		name = string(label[:4])
+		for len(name) > 0 && name[len(name)-1] == ' ' {
+			name = name[:len(name)-1]
+		}
+		if !slices.Contains(wanted, name) {
+			if err := g.skip(); err != nil {
+				return "", nil, fmt.Errorf("skipping block %s: %w", name, err)
+			}
+			return name, nil, nil
+		}
+	}
+	data, err := g.record(limit)
+	if err != nil {
+		return "", nil, fmt.Errorf("reading block %s: %w", name, err)
+	}
+	return name, data, nil
+}
+
+func (loader *particleLoader) loadGadget(r io.Reader, units GadgetUnits) (*GadgetHeader, error) {
+	g := &gadgetReader{in: bufio.NewReader(r)}
+	// The first size is 256 for the header of format 1, or 8 for the label of format 2,
+	// in either byte order.
+	first, err := g.in.Peek(4)
+	if err != nil {
+		return nil, errors.New("not a GADGET snapshot")
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(first) {
+		case 256:
+			g.order, g.format = order, 1
+		case 8:
+			g.order, g.format = order, 2
+		}
+		if g.order != nil {
+			break
+		}
+	}
+	if g.order == nil {
+		return nil, errors.New("not a GADGET snapshot")
+	}
+
+	name, data, err := g.block([]string{"HEAD"}, 256)
+	if err != nil {
+		return nil, err
+	}
+	if (g.format == 2 && name != "HEAD") || len(data) != 256 {
+		return nil, fmt.Errorf("invalid GADGET header block %q of %d bytes", name, len(data))
+	}
+	header := &GadgetHeader{}
+	binary.Read(bytes.NewReader(data), g.order, header)
+	if header.NumFiles > 1 {
+		return nil, fmt.Errorf("snapshots split over %d files are not supported", header.NumFiles)
+	}
+	n, withMass := 0, 0
+	for t, count := range header.NPart {
+		n += int(count)
+		if header.MassTable[t] == 0 {
+			withMass += int(count)
+		}
+	}
+
+	// The blocks we need, by name in format 2 or in order in format 1.
+	blocks := make(map[string][]byte)
+	wanted := []string{"POS", "VEL", "ID"}
+	if withMass > 0 {
+		wanted = append(wanted, "MASS")
+	}
+	for len(blocks) < len(wanted) {
+		// No block we read holds more than 3 float64 per particle.
+		name, data, err := g.block(wanted, min(24*n, math.MaxInt32))
+		if errors.Is(err, io.EOF) {
+			for _, name := range wanted {
+				if _, ok := blocks[name]; !ok {
+					return nil, fmt.Errorf("missing block %s", name)
+				}
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		if g.format == 1 {
+			name = wanted[len(blocks)]
+		}
+		if _, ok := blocks[name]; !ok && data != nil {
+			blocks[name] = data
+		}
+	}
+
+	// The element size of a block of count elements, 4 or 8.
+	element := func(name string, count int) (int, error) {
+		size := len(blocks[name])
+		if count > 0 && (size == 4*count || size == 8*count) {
+			return size / count, nil
+		} else if count == 0 && size == 0 {
+			return 4, nil
+		}
+		return 0, fmt.Errorf("block %s has %d bytes for %d values", name, size, count)
+	}
+	float := func(data []byte, size, i int) float64 {
+		if size == 4 {
+			return float64(math.Float32frombits(g.order.Uint32(data[4*i:])))
+		}
+		return math.Float64frombits(g.order.Uint64(data[8*i:]))
+	}
+	posSize, err := element("POS", 3*n)
+	if err != nil {
+		return nil, err
+	}
+	velSize, err := element("VEL", 3*n)
+	if err != nil {
+		return nil, err
+	}
+	idSize, err := element("ID", n)
+	if err != nil {
+		return nil, err
+	}
+	massSize, err := element("MASS", withMass)
+	if err != nil {
+		return nil, err
+	}
+
+	// Particles that differ only in z would share a point of the tree, so they are
+	// merged into the first of them, with their total mass and momentum.
+	type projected struct {
+		index     int // 0-based, of the first particle merged into it.
+		x, y      float64
+		vx, vy, m float64
+		id        int64
+	}
+	var merged []projected
+	at := make(map[[2]float64]int)
+	length, velocity, mass := units.scales()
+	i, massIndex := 0, 0
+	for t, count := range header.NPart {
+		for k := 0; k < int(count); k++ {
+			x, y := float(blocks["POS"], posSize, 3*i)*length, float(blocks["POS"], posSize, 3*i+1)*length
+			vx, vy := float(blocks["VEL"], velSize, 3*i)*velocity, float(blocks["VEL"], velSize, 3*i+1)*velocity
+			var id int64
+			if idSize == 4 {
+				id = int64(g.order.Uint32(blocks["ID"][4*i:]))
+			} else {
+				id = int64(g.order.Uint64(blocks["ID"][8*i:]))
+			}
+			m := header.MassTable[t]
+			if m == 0 {
+				m = float(blocks["MASS"], massSize, massIndex)
+				massIndex++
+			}
+			m *= mass
+			if !(m > 0) {
+				return nil, fmt.Errorf("particle %d: mass %v is not positive", i+1, m)
+			}
+			if j, ok := at[[2]float64{x, y}]; ok {
+				p := &merged[j]
+				total := p.m + m
+				p.vx, p.vy, p.m = (p.vx*p.m+vx*m)/total, (p.vy*p.m+vy*m)/total, total
+			} else {
+				at[[2]float64{x, y}] = len(merged)
+				merged = append(merged, projected{i, x, y, vx, vy, m, id})
+			}
+			i++
+		}
+	}
+	loader.unit = "particle"
+	for _, p := range merged {
+		if err := loader.add(p.index+1, particleInput{X: &p.x, Y: &p.y, VX: &p.vx, VY: &p.vy, Mass: &p.m, ID: &p.id}); err != nil {
+			return nil, fmt.Errorf("particle %d: %w", p.index+1, errors.Unwrap(err))
+		}
+	}
+	return header, nil
+}
+
+/*
+** Writes the particles as a little-endian GADGET snapshot of type 1 (halo) particles,
+** converted to GADGET units. The masses go in the mass table when they are all equal,
+** the IDs are uint64 when one does not fit in a uint32, and the time of the header is
+** stored as the time, as in a non-cosmological run.
+ */
+func WriteGadget(w io.Writer, header SnapshotHeader, particles []*Particle, opts GadgetOptions) error {
+	length, velocity, mass := opts.Units.scales()
+	sorted := sortedByID(particles)
+	n := len(sorted)
+
+	gadget := GadgetHeader{NumFiles: 1, Time: header.Time * velocity / length}
+	gadget.NPart[1], gadget.NPartTotal[1] = uint32(n), uint32(n)
+	gadget.NPartTotalHighWord[1] = uint32(uint64(n) >> 32)
+	equalMass, longIDs := true, false
+	for _, p := range sorted {
+		equalMass = equalMass && p.mass == sorted[0].mass
+		longIDs = longIDs || p.id < 0 || p.id > math.MaxUint32
+	}
+	if equalMass && n > 0 {
+		gadget.MassTable[1] = sorted[0].mass / mass
+	}
+
+	out := bufio.NewWriter(w)
+	order := binary.LittleEndian
+	writeBlock := func(name string, data []byte) {
+		if opts.Format != 1 {
+			label := order.AppendUint32(nil, 8)
+			label = append(label, fmt.Sprintf("%-4s", name)...)
+			label = order.AppendUint32(label, uint32(len(data)+8))
+			label = order.AppendUint32(label, 8)
+			out.Write(label)
+		}
+		out.Write(order.AppendUint32(nil, uint32(len(data))))
+		out.Write(data)
+		out.Write(order.AppendUint32(nil, uint32(len(data))))
+	}
+	appendFloat := func(data []byte, v float64) []byte {
+		if opts.Double {
+			return order.AppendUint64(data, math.Float64bits(v))
+		}
+		return order.AppendUint32(data, math.Float32bits(float32(v)))
+	}
+
+	headerData, _ := binary.Append(nil, order, &gadget)
+	writeBlock("HEAD", headerData)
+	var data []byte
+	for _, p := range sorted {
+		data = appendFloat(appendFloat(appendFloat(data, p.x/length), p.y/length), 0)
+	}
+	writeBlock("POS", data)
+	data = data[:0]
+	for _, p := range sorted {
+		data = appendFloat(appendFloat(appendFloat(data, p.vx/velocity), p.vy/velocity), 0)
+	}
+	writeBlock("VEL", data)
+	data = data[:0]
+	for _, p := range sorted {
+		if longIDs {
+			data = order.AppendUint64(data, uint64(p.id))
+		} else {
+			data = order.AppendUint32(data, uint32(p.id))
+		}
+	}
+	writeBlock("ID", data)
+	if !equalMass {
+		data = data[:0]
+		for _, p := range sorted {
+			data = appendFloat(data, p.mass/mass)
+		}
+		writeBlock("MASS", data)
+	}
+	return out.Flush()
+}
+
+/*
+** Writes a GADGET snapshot to path, replacing the file.
+ */
+func WriteGadgetFile(path string, header SnapshotHeader, particles []*Particle, opts GadgetOptions) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := WriteGadget(file, header, particles, opts); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
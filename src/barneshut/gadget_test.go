@@ -0,0 +1,84 @@
+package barneshut
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Appends data as a Fortran record, framed by its size.
+func appendRecord(buf []byte, data []byte) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(data)))
+	buf = append(buf, data...)
+	return binary.LittleEndian.AppendUint32(buf, uint32(len(data)))
+}
+
+func TestLoadGadgetMergesProjectedParticles(t *testing.T) {
+	// A 2x2x2 lattice of unit masses, moving in x by their z.
+	var header GadgetHeader
+	header.NPart[1], header.MassTable[1], header.NumFiles = 8, 1, 1
+	var head bytes.Buffer
+	binary.Write(&head, binary.LittleEndian, &header)
+	var pos, vel, ids []byte
+	for i := 0; i < 8; i++ {
+		x, y, z := float32(i&1), float32(i>>1&1), float32(i>>2)
+		for _, v := range []float32{x, y, z} {
+			pos = binary.LittleEndian.AppendUint32(pos, math.Float32bits(v))
+		}
+		for _, v := range []float32{z, 0, 0} {
+			vel = binary.LittleEndian.AppendUint32(vel, math.Float32bits(v))
+		}
+		ids = binary.LittleEndian.AppendUint32(ids, uint32(100+i))
+	}
+	var file []byte
+	for _, block := range [][]byte{head.Bytes(), pos, vel, ids} {
+		file = appendRecord(file, block)
+	}
+
+	particles, loaded, err := LoadGadget(bytes.NewReader(file), GadgetUnits{Mass: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.NumParticles() != 8 || len(particles) != 4 {
+		t.Fatalf("loaded %d particles, want the 4 columns of the lattice", len(particles))
+	}
+	for i, p := range particles {
+		if p.id != int64(100+i) || p.mass != 2 || p.vx != 0.5 || p.x != float64(i&1) || p.y != float64(i>>1&1) {
+			t.Errorf("particle %d: id %d at (%v, %v) with mass %v and vx %v", i, p.id, p.x, p.y, p.mass, p.vx)
+		}
+	}
+
+	// A record claiming more bytes than the particles can hold is rejected before it is read.
+	binary.LittleEndian.PutUint32(file[4+256+4:], 1<<30)
+	if _, _, err := LoadGadget(bytes.NewReader(file), GadgetUnits{}); err == nil {
+		t.Error("loaded a POS block of 1 GiB for 8 particles")
+	}
+}
+
+/*
+** A header claiming 2^28 particles allows a POS record of up to 2 GiB, which a file of
+** a few bytes must not get allocated before it runs out.
+ */
+func TestLoadGadgetTruncatedLargeRecord(t *testing.T) {
+	var header GadgetHeader
+	header.NPart[1], header.MassTable[1], header.NumFiles = 1<<28, 1, 1
+	var head bytes.Buffer
+	binary.Write(&head, binary.LittleEndian, &header)
+	file := appendRecord(nil, head.Bytes())
+	file = binary.LittleEndian.AppendUint32(file, math.MaxInt32-7)
+	file = append(file, make([]byte, 64)...)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, _, err := LoadGadget(bytes.NewReader(file), GadgetUnits{})
+	runtime.ReadMemStats(&after)
+	if err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("got error %v, want a truncated record", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+		t.Errorf("allocated %d bytes for a file of %d", allocated, len(file))
+	}
+}
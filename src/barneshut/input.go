@@ -0,0 +1,362 @@
+package barneshut
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Formats of particle input files.
+const (
+	FormatText   = "text"   // x y [vx vy mass id] per line, or the columns named by a "# columns" line. Other lines starting with # are skipped.
+	FormatCSV    = "csv"    // A header naming the columns x, y and optionally vx, vy, ax, ay, mass, id.
+	FormatJSON   = "json"   // An array of {"x", "y", "vx", "vy", "ax", "ay", "mass", "id"} objects, x and y required.
+	FormatBinary = "binary" // A binary snapshot, see WriteBinarySnapshot.
+	FormatGadget = "gadget" // A GADGET format 1 or 2 snapshot in GADGET units, see LoadGadget.
+)
+
+/*
+** An invalid particle in an input file, at a 1-based line.
+ */
+type InputError struct {
+	Line int
+	Err  error
+}
+
+func (err *InputError) Error() string {
+	return fmt.Sprintf("line %d: %v", err.Line, err.Err)
+}
+
+func (err *InputError) Unwrap() error {
+	return err.Err
+}
+
+/*
+** The format of an input file: format if it is not empty, else picked from the
+** extension, .csv, .json, .bhs for binary snapshots, .gadget, anything else text.
+ */
+func InputFormat(path string, format string) string {
+	if format != "" {
+		return format
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return FormatCSV
+	case ".json":
+		return FormatJSON
+	case ".bhs":
+		return FormatBinary
+	case ".gadget":
+		return FormatGadget
+	}
+	return FormatText
+}
+
+/*
+** Loads particles from a file, with the format picked by InputFormat.
+ */
+func LoadParticlesFile(path string, format string) ([]*Particle, error) {
+	format = InputFormat(path, format)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	particles, err := LoadParticles(file, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return particles, nil
+}
+
+/*
+** Loads particles in one of the Format* formats. Missing velocities are 0, a missing
+** mass is 1 and a missing ID is the particle's position in the file. Positions,
+** velocities and masses must be finite, positions within the root of the tree, masses
+** positive, and IDs and positions unique.
+ */
+func LoadParticles(r io.Reader, format string) ([]*Particle, error) {
+	loader := particleLoader{ids: make(map[int64]int), positions: make(map[[2]float64]int)}
+	var err error
+	switch format {
+	case FormatText, "":
+		err = loader.loadText(r)
+	case FormatCSV:
+		err = loader.loadCSV(r)
+	case FormatJSON:
+		err = loader.loadJSON(r)
+	case FormatBinary:
+		err = loader.loadBinary(r)
+	case FormatGadget:
+		_, err = loader.loadGadget(r, GadgetUnits{})
+	default:
+		return nil, fmt.Errorf("unknown input format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return loader.particles, nil
+}
+
+type particleLoader struct {
+	particles []*Particle
+	ids       map[int64]int      // Line of each ID.
+	positions map[[2]float64]int // Line of each position, the tree cannot hold two particles at one point.
+	unit      string             // What the lines count in the errors, "line" if empty.
+}
+
+// A particle as read, the optional fields nil when missing.
+type particleInput struct {
+	X, Y   *float64
+	VX, VY *float64
+	AX, AY *float64
+	Mass   *float64
+	ID     *int64
+}
+
+func (loader *particleLoader) add(line int, input particleInput) error {
+	fail := func(format string, args ...any) error {
+		return &InputError{Line: line, Err: fmt.Errorf(format, args...)}
+	}
+	if input.X == nil || input.Y == nil {
+		return fail("missing x or y")
+	}
+	p := NewParticle(*input.X, *input.Y)
+	p.id = int64(len(loader.particles))
+	if input.VX != nil {
+		p.vx = *input.VX
+	}
+	if input.VY != nil {
+		p.vy = *input.VY
+	}
+	if input.AX != nil {
+		p.fx = *input.AX
+	}
+	if input.AY != nil {
+		p.fy = *input.AY
+	}
+	if input.Mass != nil {
+		p.mass = *input.Mass
+	}
+	if input.ID != nil {
+		p.id = *input.ID
+	}
+
+	for _, value := range []float64{p.x, p.y, p.vx, p.vy, p.fx, p.fy, p.mass} {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return fail("value %v is not finite", value)
+		}
+	}
+	if p.mass <= 0 {
+		return fail("mass %v is not positive", p.mass)
+	}
+	// The root of the tree spans the int64 range, and particles outside it never land
+	// in separate quadrants.
+	if math.Abs(p.x) > float64(math.MaxInt64) || math.Abs(p.y) > float64(math.MaxInt64) {
+		return fail("position (%v, %v) is outside the tree, |x| and |y| must be at most %v", p.x, p.y, float64(math.MaxInt64))
+	}
+	unit := loader.unit
+	if unit == "" {
+		unit = "line"
+	}
+	if other, ok := loader.ids[p.id]; ok {
+		return fail("id %d already used on %s %d", p.id, unit, other)
+	}
+	if other, ok := loader.positions[[2]float64{p.x, p.y}]; ok {
+		return fail("position (%v, %v) already used on %s %d", p.x, p.y, unit, other)
+	}
+	loader.ids[p.id] = line
+	loader.positions[[2]float64{p.x, p.y}] = line
+	loader.particles = append(loader.particles, p)
+	return nil
+}
+
+func (loader *particleLoader) loadText(r io.Reader) error {
+	var columns []string // Named by a "# columns" line, as in snapshots.
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "#" && fields[1] == "columns" {
+			var err error
+			if columns, err = parseColumns(fields[2:]); err != nil {
+				return &InputError{Line: line, Err: err}
+			}
+			continue
+		}
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		names := columns
+		if names == nil {
+			if len(fields) != 2 && len(fields) != 4 && len(fields) != 5 && len(fields) != 6 {
+				return &InputError{Line: line, Err: fmt.Errorf("expected x y [vx vy [mass [id]]], got %d fields", len(fields))}
+			}
+			names = []string{"x", "y", "vx", "vy", "mass", "id"}
+		} else if len(fields) != len(names) {
+			return &InputError{Line: line, Err: fmt.Errorf("expected %d columns, got %d fields", len(names), len(fields))}
+		}
+		var input particleInput
+		for i, field := range fields {
+			if err := input.set(names[i], field); err != nil {
+				return &InputError{Line: line, Err: err}
+			}
+		}
+		if err := loader.add(line, input); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (loader *particleLoader) loadCSV(r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return &InputError{Line: 1, Err: errors.New("missing header")}
+		}
+		return err
+	}
+	columns, err := parseColumns(header)
+	if err != nil {
+		return &InputError{Line: 1, Err: err}
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return &InputError{Line: parseErr.Line, Err: parseErr.Err}
+		} else if err != nil {
+			return err
+		}
+		line, _ := reader.FieldPos(0)
+		var input particleInput
+		for i, field := range record {
+			if err := input.set(columns[i], field); err != nil {
+				return &InputError{Line: line, Err: err}
+			}
+		}
+		if err := loader.add(line, input); err != nil {
+			return err
+		}
+	}
+}
+
+func (loader *particleLoader) loadJSON(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	lineAt := func(offset int64) int {
+		return 1 + bytes.Count(data[:min(offset, int64(len(data)))], []byte("\n"))
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return &InputError{Line: lineAt(decoder.InputOffset()), Err: errors.New("expected an array of particles")}
+	}
+	for decoder.More() {
+		// The offset before an element is the end of the previous one, skip to its start.
+		start := decoder.InputOffset()
+		for start < int64(len(data)) && strings.ContainsRune(" \t\r\n,", rune(data[start])) {
+			start++
+		}
+		var input particleInput
+		if err := decoder.Decode(&input); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				return &InputError{Line: lineAt(syntaxErr.Offset), Err: err}
+			}
+			return &InputError{Line: lineAt(start), Err: err}
+		}
+		if err := loader.add(lineAt(start), input); err != nil {
+			return err
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return &InputError{Line: lineAt(decoder.InputOffset()), Err: err}
+	}
+	return nil
+}
+
+// The line of an invalid particle is its 1-based position in the snapshot.
+func (loader *particleLoader) loadBinary(r io.Reader) error {
+	snapshot, err := ReadBinarySnapshot(r)
+	if err != nil {
+		return err
+	}
+	for i, p := range snapshot.Particles() {
+		input := particleInput{X: &p.x, Y: &p.y, VX: &p.vx, VY: &p.vy, AX: &p.fx, AY: &p.fy, Mass: &p.mass, ID: &p.id}
+		if err := loader.add(i+1, input); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks the column names of a header, which must include x and y.
+func parseColumns(header []string) ([]string, error) {
+	columns := make([]string, len(header))
+	seen := make(map[string]bool)
+	for i, name := range header {
+		columns[i] = strings.ToLower(strings.TrimSpace(name))
+		if err := (&particleInput{}).set(columns[i], "0"); err != nil || seen[columns[i]] {
+			return nil, fmt.Errorf("unknown or repeated column %q", name)
+		}
+		seen[columns[i]] = true
+	}
+	if !seen["x"] || !seen["y"] {
+		return nil, errors.New("header must name the x and y columns")
+	}
+	return columns, nil
+}
+
+// Parses the named field.
+func (input *particleInput) set(name string, field string) error {
+	field = strings.TrimSpace(field)
+	if name == "id" {
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid id %q", field)
+		}
+		input.ID = &id
+		return nil
+	}
+	value, err := strconv.ParseFloat(field, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", name, field)
+	}
+	switch name {
+	case "x":
+		input.X = &value
+	case "y":
+		input.Y = &value
+	case "vx":
+		input.VX = &value
+	case "vy":
+		input.VY = &value
+	case "ax":
+		input.AX = &value
+	case "ay":
+		input.AY = &value
+	case "mass":
+		input.Mass = &value
+	default:
+		return fmt.Errorf("unknown field %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package barneshut
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLoadParticlesRejects(t *testing.T) {
+	for _, c := range []struct{ input, want string }{
+		{"0 0\n1 NaN\n", "not finite"},
+		{"0 0\n1 1 0 0 -1\n", "not positive"},
+		{"0 0\n0 0\n", "already used"},
+		{"0 0\n1e19 1\n", "outside the tree"},
+		{"0 0\n1 -1e19\n", "outside the tree"},
+	} {
+		_, err := LoadParticles(strings.NewReader(c.input), FormatText)
+		var inputErr *InputError
+		if !errors.As(err, &inputErr) || inputErr.Line != 2 || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: got error %v, want %q on line 2", c.input, err, c.want)
+		}
+	}
+	// The largest coordinates the root holds are accepted.
+	particles, err := LoadParticles(strings.NewReader("-9.2e18 9.2e18\n9.2e18 -9.2e18\n9.2e18 9.2e18\n"), FormatText)
+	if err != nil || len(particles) != 3 {
+		t.Fatalf("loaded %d particles at the edges of the root: %v", len(particles), err)
+	}
+	if stats := ComputeTreeStats(newTree(particles)); stats.Particles != 3 {
+		t.Errorf("tree of %d particles", stats.Particles)
+	}
+}
@@ -0,0 +1,209 @@
+package barneshut
+
+import (
+	"fmt"
+	"math"
+)
+
+// Force walks of a ParticleSet.
+const (
+	WalkParticle = "particle" // One tree walk per particle.
+	WalkGroup    = "group"    // One tree walk per group of nearby particles, sharing the interaction list.
+	WalkDualTree = "dualtree" // Simultaneous walk of the tree against itself, lists shared down the tree.
+)
+
+// Largest number of particles in a group of the group walk.
+const setGroupSize = 32
+
+/*
+** Selects the force walk used by Step.
+ */
+func (set *ParticleSet) SetWalk(walk string) error {
+	switch walk {
+	case WalkParticle, WalkGroup, WalkDualTree, "":
+		set.walk = walk
+		return nil
+	}
+	return fmt.Errorf("unknown walk %q", walk)
+}
+
+/*
+** Group walk: the tree is cut into groups, the largest nodes with at most
+** setGroupSize particles. Each group walks the tree once, accepting a node when it
+** passes the opening criterion for the closest point of the group's bounding box,
+** and all its particles sum the same list. A particle in its own list adds nothing
+** since dx and dy are 0.
+ */
+func (set *ParticleSet) groupForces(numThreads int) {
+	groups := set.tree.groups(0, setGroupSize, nil)
+	set.parallelChunks(len(groups), numThreads, func(start, end int) {
+		var list interactionList
+		var visits, interactions int64
+		for _, group := range groups[start:end] {
+			list.reset()
+			visits += set.groupWalk(group, &list)
+			for i := set.tree.start[group]; i < set.tree.end[group]; i++ {
+				set.ax[i], set.ay[i] = accumulateForce(set.x[i], set.y[i], list.x, list.y, list.mass)
+				interactions += int64(len(list.x))
+			}
+		}
+		set.addWalkStats(visits, interactions)
+	})
+}
+
+// Appends the largest nodes below node with at most size particles, in tree order.
+func (tree *setTree) groups(node int32, size int32, groups []int32) []int32 {
+	if tree.end[node]-tree.start[node] <= size || tree.isLeaf(node) {
+		return append(groups, node)
+	}
+	for _, child := range tree.children[node] {
+		if child >= 0 {
+			groups = tree.groups(child, size, groups)
+		}
+	}
+	return groups
+}
+
+func (set *ParticleSet) groupWalk(group int32, list *interactionList) int64 {
+	tree := &set.tree
+	minX, maxX := set.x[tree.start[group]], set.x[tree.start[group]]
+	minY, maxY := set.y[tree.start[group]], set.y[tree.start[group]]
+	for i := tree.start[group] + 1; i < tree.end[group]; i++ {
+		minX, maxX = min(minX, set.x[i]), max(maxX, set.x[i])
+		minY, maxY = min(minY, set.y[i]), max(maxY, set.y[i])
+	}
+
+	var stack [128]int32
+	var visits int64 = 0
+	top := 0
+	stack[top] = 0
+	top++
+	for top > 0 {
+		top--
+		node := stack[top]
+		visits++
+		overlaps := tree.start[node] < tree.end[group] && tree.start[group] < tree.end[node]
+
+		// Distance from the COM to the closest point of the group's box.
+		dx := max(minX-tree.comX[node], 0, tree.comX[node]-maxX)
+		dy := max(minY-tree.comY[node], 0, tree.comY[node]-maxY)
+		D := math.Sqrt(dx*dx + dy*dy + SOFTENING)
+
+		if !overlaps && tree.size[node]/D < THETA {
+			list.add(tree.comX[node], tree.comY[node], tree.mass[node])
+		} else if tree.isLeaf(node) {
+			for j := tree.start[node]; j < tree.end[node]; j++ {
+				list.add(set.x[j], set.y[j], set.mass[j])
+			}
+		} else {
+			for _, child := range tree.children[node] {
+				if child >= 0 {
+					stack[top] = child
+					top++
+				}
+			}
+		}
+	}
+	return visits
+}
+
+/*
+** Dual-tree walk: interact(A, B) gives every particle of the target node A the
+** sources of node B. When A and B are well separated ((sA + sB) / D < THETA) B's COM
+** goes into A's list, which all particles below A share. Two leaves add B's particles
+** directly, otherwise the larger of the two is split.
+** Above the task size the walk runs sequentially, and the pairs whose target is
+** small enough are collected by target. The targets are disjoint subtrees, so each
+** is finished by one thread without locks.
+ */
+func (set *ParticleSet) dualTreeForces(numThreads int) {
+	tree := &set.tree
+	lists := make([]interactionList, len(tree.start))
+	taskSize := int32(max(setGroupSize, set.Len()/(max(1, numThreads)*16)))
+
+	var targets []int32
+	pairs := make(map[int32][]int32)
+	walker := dualTreeWalker{set: set, lists: lists, taskSize: taskSize}
+	walker.deferPair = func(a, b int32) {
+		if _, ok := pairs[a]; !ok {
+			targets = append(targets, a)
+		}
+		pairs[a] = append(pairs[a], b)
+	}
+	walker.interact(0, 0)
+	visits := walker.visits
+
+	set.parallelChunks(len(targets), numThreads, func(start, end int) {
+		worker := dualTreeWalker{set: set, lists: lists, taskSize: -1}
+		for _, target := range targets[start:end] {
+			for _, source := range pairs[target] {
+				worker.interact(target, source)
+			}
+		}
+		set.addWalkStats(worker.visits, 0)
+	})
+
+	// Each leaf sums its own list and those of its ancestors.
+	leaves := tree.groups(0, 0, nil)
+	set.parallelChunks(len(leaves), numThreads, func(start, end int) {
+		var interactions int64
+		for _, leaf := range leaves[start:end] {
+			for i := tree.start[leaf]; i < tree.end[leaf]; i++ {
+				var ax, ay float64
+				for node := leaf; node >= 0; node = tree.parent[node] {
+					list := &lists[node]
+					dax, day := accumulateForce(set.x[i], set.y[i], list.x, list.y, list.mass)
+					ax += dax
+					ay += day
+					interactions += int64(len(list.x))
+				}
+				set.ax[i], set.ay[i] = ax, ay
+			}
+		}
+		set.addWalkStats(0, interactions)
+	})
+	set.addWalkStats(visits, 0)
+}
+
+type dualTreeWalker struct {
+	set       *ParticleSet
+	lists     []interactionList
+	taskSize  int32            // Pairs with a target of at most this many particles are deferred, -1 for none.
+	deferPair func(a, b int32) // Collects the deferred pairs.
+	visits    int64
+}
+
+func (walker *dualTreeWalker) interact(a, b int32) {
+	set, tree := walker.set, &walker.set.tree
+	if walker.taskSize >= 0 && tree.end[a]-tree.start[a] <= walker.taskSize {
+		walker.deferPair(a, b)
+		return
+	}
+	walker.visits++
+
+	overlaps := tree.start[a] < tree.end[b] && tree.start[b] < tree.end[a]
+	dx := tree.comX[a] - tree.comX[b]
+	dy := tree.comY[a] - tree.comY[b]
+	D := math.Sqrt(dx*dx + dy*dy + SOFTENING)
+
+	leafA, leafB := tree.isLeaf(a), tree.isLeaf(b)
+	if !overlaps && (tree.size[a]+tree.size[b])/D < THETA {
+		walker.lists[a].add(tree.comX[b], tree.comY[b], tree.mass[b])
+	} else if leafA && leafB {
+		for j := tree.start[b]; j < tree.end[b]; j++ {
+			walker.lists[a].add(set.x[j], set.y[j], set.mass[j])
+		}
+	} else if leafB || (!leafA && tree.size[a] >= tree.size[b]) {
+		for _, child := range tree.children[a] {
+			if child >= 0 {
+				walker.interact(child, b)
+			}
+		}
+	} else {
+		for _, child := range tree.children[b] {
+			if child >= 0 {
+				walker.interact(a, child)
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package barneshut
+
+import (
+	"fmt"
+	"testing"
+)
+
+var walks = []string{WalkParticle, WalkGroup, WalkDualTree}
+
+/*
+** Every walk opens nodes with s/D < THETA or a stricter criterion, so none may be less
+** accurate than the particle walk, and the shared walks visit fewer nodes.
+ */
+func TestWalkForces(t *testing.T) {
+	particles := testParticles(5000, 8)
+	ax, ay := directAccelerations(particles)
+	var particleP99, particleMedian float64
+	var particleVisits int64
+	for _, walk := range walks {
+		for _, numThreads := range []int{1, 4} {
+			set := setAccelerations(particles, walk, numThreads)
+			p99, median := forceErrors(particles, ax, ay)
+			visits, interactions := set.WalkStats()
+			t.Logf("%s, %d threads: 99th percentile error %.3g, median %.3g, %d nodes visited, %d interactions", walk, numThreads, p99, median, visits, interactions)
+			if p99 > 0.1 || median > 0.01 {
+				t.Errorf("%s, %d threads: 99th percentile error %.3g, median %.3g against the direct sum", walk, numThreads, p99, median)
+			}
+			if walk == WalkParticle {
+				particleP99, particleMedian, particleVisits = p99, median, visits
+				continue
+			}
+			if p99 > particleP99 || median > particleMedian {
+				t.Errorf("%s, %d threads: errors %.3g and %.3g, the particle walk's are %.3g and %.3g", walk, numThreads, p99, median, particleP99, particleMedian)
+			}
+			// The group walk visits more than 10 times fewer nodes, the dual-tree walk 2.
+			limit := particleVisits / 2
+			if walk == WalkGroup {
+				limit = particleVisits / 10
+			}
+			if visits >= limit {
+				t.Errorf("%s, %d threads: %d nodes visited, the particle walk visits %d", walk, numThreads, visits, particleVisits)
+			}
+		}
+	}
+}
+
+/*
+** One time-step of each walk on 1 thread, with the nodes visited and the interactions
+** summed per step:
+**
+**	go test -bench=Walk ./src/barneshut
+ */
+func BenchmarkWalk(b *testing.B) {
+	for _, walk := range walks {
+		b.Run(fmt.Sprintf("walk=%s", walk), func(b *testing.B) {
+			set := NewParticleSet(testParticles(20000, 1))
+			set.SetWalk(walk)
+			for i := 0; i < b.N; i++ {
+				set.Step(1, 1)
+			}
+			visits, interactions := set.WalkStats()
+			b.ReportMetric(float64(visits), "visits/op")
+			b.ReportMetric(float64(interactions), "interactions/op")
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package barneshut
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Options of a Movie.
+type MovieOptions struct {
+	Render   RenderOptions // The viewport is fitted to the first frame if empty.
+	FPS      float64       // Frames per second, 10 if 0.
+	Track    bool          // Keep the center of mass in the middle of the viewport.
+	Annotate bool          // Draw the step and time in the top left corner.
+}
+
+/*
+** Records frames into an animated GIF, or into a numbered PNG sequence when the path
+** ends in .png: movie_000000.png, movie_000001.png, ... for movie.png, as ffmpeg's
+** movie_%06d.png reads them. A GIF is kept in memory, a byte per pixel of every frame,
+** and written by Close.
+ */
+type Movie struct {
+	path   string
+	opts   MovieOptions
+	frames int
+	anim   gif.GIF
+}
+
+func NewMovie(path string, opts MovieOptions) (*Movie, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".gif" && ext != ".png" {
+		return nil, fmt.Errorf("%s: movies are .gif or .png sequences", path)
+	}
+	if opts.FPS <= 0 {
+		opts.FPS = 10
+	}
+	return &Movie{path: path, opts: opts}, nil
+}
+
+/*
+** Renders a frame of the particles after the step.
+ */
+func (movie *Movie) AddFrame(step int, time float64, particles []*Particle) error {
+	render := movie.opts.Render.FitViewport(particles)
+	movie.opts.Render = render // Fitted once, to the first frame.
+	if movie.opts.Track && len(particles) > 0 {
+		// Move the viewport of the first frame to center the center of mass.
+		var mass, x, y float64
+		for _, p := range particles {
+			mass, x, y = mass+p.mass, x+p.mass*p.x, y+p.mass*p.y
+		}
+		halfWidth, halfHeight := (render.MaxX-render.MinX)/2, (render.MaxY-render.MinY)/2
+		render.MinX, render.MaxX = x/mass-halfWidth, x/mass+halfWidth
+		render.MinY, render.MaxY = y/mass-halfHeight, y/mass+halfHeight
+	}
+	img := RenderParticles(particles, render)
+	if movie.opts.Annotate {
+		label := fmt.Sprintf("step %d  time %s", step, strconv.FormatFloat(time, 'g', 6, 64))
+		drawText(img, 8, 8, 2, label, color.White)
+	}
+
+	index := movie.frames
+	movie.frames++
+	if strings.EqualFold(filepath.Ext(movie.path), ".png") {
+		ext := filepath.Ext(movie.path)
+		path := fmt.Sprintf("%s_%06d%s", strings.TrimSuffix(movie.path, ext), index, ext)
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		if err := png.Encode(file, img); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}
+	frame := image.NewPaletted(img.Bounds(), palette.Plan9)
+	draw.Draw(frame, frame.Bounds(), img, image.Point{}, draw.Src)
+	movie.anim.Image = append(movie.anim.Image, frame)
+	movie.anim.Delay = append(movie.anim.Delay, int(100/movie.opts.FPS+0.5)) // In 1/100 s.
+	return nil
+}
+
+func (movie *Movie) Frames() int {
+	return movie.frames
+}
+
+/*
+** Writes the GIF, looping forever. A PNG sequence is already written.
+ */
+func (movie *Movie) Close() error {
+	if !strings.EqualFold(filepath.Ext(movie.path), ".gif") {
+		return nil
+	}
+	if movie.frames == 0 {
+		return fmt.Errorf("%s: no frames", movie.path)
+	}
+	return WriteFileAtomic(movie.path, func(w io.Writer) error { return gif.EncodeAll(w, &movie.anim) })
+}
+
+/*
+** The particles of a trajectory frame, of unit mass as trajectories hold no masses,
+** and at rest if it has no velocities.
+ */
+func (frame *TrajectoryFrame) Particles() []*Particle {
+	particles := make([]*Particle, len(frame.ID))
+	for i := range particles {
+		p := NewParticle(frame.X[i], frame.Y[i])
+		p.id = frame.ID[i]
+		if frame.VX != nil {
+			p.vx, p.vy = frame.VX[i], frame.VY[i]
+		}
+		particles[i] = p
+	}
+	return particles
+}
+
+// Rows of the 5x7 glyphs of drawText, the high bit of 5 the leftmost pixel.
+var glyphs = map[rune][7]uint8{
+	'0': {0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e},
+	'1': {0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'2': {0x0e, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1f},
+	'3': {0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e},
+	'4': {0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02},
+	'5': {0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e},
+	'6': {0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e},
+	'7': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e},
+	'9': {0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c},
+	'.': {0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x0c},
+	'-': {0x00, 0x00, 0x00, 0x1f, 0x00, 0x00, 0x00},
+	'+': {0x00, 0x04, 0x04, 0x1f, 0x04, 0x04, 0x00},
+	'e': {0x00, 0x00, 0x0e, 0x11, 0x1f, 0x10, 0x0e},
+	'i': {0x04, 0x00, 0x0c, 0x04, 0x04, 0x04, 0x0e},
+	'm': {0x00, 0x00, 0x1a, 0x15, 0x15, 0x11, 0x11},
+	'p': {0x00, 0x00, 0x1e, 0x11, 0x1e, 0x10, 0x10},
+	's': {0x00, 0x00, 0x0e, 0x10, 0x0e, 0x01, 0x1e},
+	't': {0x08, 0x08, 0x1c, 0x08, 0x08, 0x09, 0x06},
+}
+
+/*
+** Draws text in a 5x7 pixel font scaled by scale, with its top left corner at (x, y).
+** Characters without a glyph are drawn as spaces.
+ */
+func drawText(img draw.Image, x, y, scale int, text string, c color.Color) {
+	for _, r := range text {
+		rows := glyphs[r]
+		for row, bits := range rows {
+			for col := 0; col < 5; col++ {
+				if bits&(0x10>>col) == 0 {
+					continue
+				}
+				rect := image.Rect(x+col*scale, y+row*scale, x+(col+1)*scale, y+(row+1)*scale)
+				draw.Draw(img, rect, image.NewUniform(c), image.Point{}, draw.Src)
+			}
+		}
+		x += 6 * scale
+	}
+}
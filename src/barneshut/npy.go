@@ -0,0 +1,351 @@
+package barneshut
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+** NumPy .npy arrays and .npz archives of snapshots, readable with numpy.load:
+**
+**	magic    "\x93NUMPY", major and minor version bytes
+**	header   uint16 length (uint32 from version 2.0), then a Python dict literal
+**	         {'descr': '<f8', 'fortran_order': False, 'shape': (n, 2), }
+**	         padded with spaces and a newline to a multiple of 64 bytes
+**	data     the elements in C order, little-endian
+**
+** A snapshot is the arrays id (n,) int64, position, velocity and acceleration
+** (n, 2) float64, mass (n,) float64, and the scalars step int64 and time float64,
+** sorted by ID. A .npz archive is a zip of "<name>.npy" files, as numpy.savez writes.
+ */
+const npyMagic = "\x93NUMPY"
+
+// The arrays of a snapshot, in the order they are written.
+var npySnapshotArrays = []string{"id", "position", "velocity", "acceleration", "mass", "step", "time"}
+
+/*
+** An array of int64 or float64 elements, Int64 or Float64 holding the data in C order.
+ */
+type NPYArray struct {
+	Shape   []int
+	Int64   []int64
+	Float64 []float64
+}
+
+func (array *NPYArray) descr() string {
+	if array.Int64 != nil {
+		return "<i8"
+	}
+	return "<f8"
+}
+
+// The number of elements of the shape, 1 for a scalar.
+func (array *NPYArray) size() int {
+	size := 1
+	for _, dim := range array.Shape {
+		size *= dim
+	}
+	return size
+}
+
+/*
+** Writes the array as a version 1.0 .npy file.
+ */
+func WriteNPY(w io.Writer, array NPYArray) error {
+	dims := make([]string, len(array.Shape))
+	for i, dim := range array.Shape {
+		dims[i] = strconv.Itoa(dim)
+	}
+	shape := strings.Join(dims, ", ")
+	if len(dims) == 1 {
+		shape += ","
+	}
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': (%s), }", array.descr(), shape)
+	// Pad so the data starts at a multiple of 64, after the magic, version and length.
+	prefix := len(npyMagic) + 2 + 2
+	header += strings.Repeat(" ", 63-(prefix+len(header))%64) + "\n"
+
+	out := bufio.NewWriter(w)
+	buf := append([]byte(npyMagic), 1, 0)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(header)))
+	buf = append(buf, header...)
+	if array.Int64 != nil {
+		for _, v := range array.Int64 {
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(v))
+		}
+	} else {
+		for _, v := range array.Float64 {
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v))
+		}
+	}
+	if _, err := out.Write(buf); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+var (
+	npyDescr   = regexp.MustCompile(`'descr':\s*'([^']*)'`)
+	npyFortran = regexp.MustCompile(`'fortran_order':\s*(True|False)`)
+	npyShape   = regexp.MustCompile(`'shape':\s*\(([^)]*)\)`)
+)
+
+// The longest .npy header ReadNPY accepts, as numpy.load.
+const maxNPYHeader = 10000
+
+/*
+** Reads a .npy file of version 1.0 to 3.0 holding little-endian int64 or float64 elements
+** in C order. The shape must fit in the bytes left in r if it can seek.
+ */
+func ReadNPY(r io.Reader) (*NPYArray, error) {
+	return readNPY(r, bytesLeft(r))
+}
+
+/*
+** Reads a .npy file of size bytes, or of unknown size if it is negative. A shape with
+** more elements than that is an error, rather than a huge allocation.
+ */
+func readNPY(r io.Reader, size int64) (*NPYArray, error) {
+	in := bufio.NewReader(r)
+	prefix := make([]byte, len(npyMagic)+2)
+	if _, err := io.ReadFull(in, prefix); err != nil || string(prefix[:len(npyMagic)]) != npyMagic {
+		return nil, errors.New("not a .npy file")
+	}
+	var length, start int // The header length and the offset of the data.
+	switch major := prefix[len(npyMagic)]; major {
+	case 1:
+		var n uint16
+		if err := binary.Read(in, binary.LittleEndian, &n); err != nil {
+			return nil, fmt.Errorf("reading .npy header: %w", err)
+		}
+		length, start = int(n), len(prefix)+2+int(n)
+	case 2, 3:
+		var n uint32
+		if err := binary.Read(in, binary.LittleEndian, &n); err != nil {
+			return nil, fmt.Errorf("reading .npy header: %w", err)
+		}
+		length, start = int(n), len(prefix)+4+int(n)
+	default:
+		return nil, fmt.Errorf("unsupported .npy version %d", major)
+	}
+	if length > maxNPYHeader {
+		return nil, fmt.Errorf("invalid .npy header length %d", length)
+	}
+	header := make([]byte, length)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return nil, fmt.Errorf("reading .npy header: %w", err)
+	}
+
+	descr, fortran, shape := npyDescr.FindSubmatch(header), npyFortran.FindSubmatch(header), npyShape.FindSubmatch(header)
+	if descr == nil || fortran == nil || shape == nil {
+		return nil, fmt.Errorf("invalid .npy header %q", strings.TrimSpace(string(header)))
+	}
+	if string(fortran[1]) == "True" {
+		return nil, errors.New("unsupported .npy array in Fortran order")
+	}
+	array := &NPYArray{}
+	elements := 1
+	for _, dim := range strings.Split(string(shape[1]), ",") {
+		if dim = strings.TrimSpace(dim); dim == "" {
+			continue
+		}
+		n, err := strconv.Atoi(dim)
+		if err != nil || n < 0 || (n > 0 && elements > math.MaxInt/8/n) {
+			return nil, fmt.Errorf("invalid .npy shape (%s)", shape[1])
+		}
+		array.Shape = append(array.Shape, n)
+		elements *= n
+	}
+
+	if size >= 0 && int64(8*elements) > size-int64(start) {
+		return nil, fmt.Errorf(".npy shape (%s) needs %d bytes of data, the file holds %d", shape[1], 8*elements, max(size-int64(start), 0))
+	}
+	data, err := readChunked(in, int64(8*elements))
+	if err != nil {
+		return nil, fmt.Errorf("reading .npy data: %w", err)
+	}
+	switch string(descr[1]) {
+	case "<i8":
+		array.Int64 = make([]int64, elements)
+		for i := range array.Int64 {
+			array.Int64[i] = int64(binary.LittleEndian.Uint64(data[8*i:]))
+		}
+	case "<f8":
+		array.Float64 = make([]float64, elements)
+		for i := range array.Float64 {
+			array.Float64[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[8*i:]))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported .npy type %s, only <i8 and <f8", descr[1])
+	}
+	return array, nil
+}
+
+/*
+** The arrays of a snapshot of the particles, by name.
+ */
+func snapshotNPYArrays(header SnapshotHeader, particles []*Particle) map[string]NPYArray {
+	sorted := sortedByID(particles)
+	n := len(sorted)
+	ids := make([]int64, n)
+	mass := make([]float64, n)
+	position, velocity, acceleration := make([]float64, 2*n), make([]float64, 2*n), make([]float64, 2*n)
+	for i, p := range sorted {
+		ids[i], mass[i] = p.id, p.mass
+		position[2*i], position[2*i+1] = p.x, p.y
+		velocity[2*i], velocity[2*i+1] = p.vx, p.vy
+		acceleration[2*i], acceleration[2*i+1] = p.fx, p.fy
+	}
+	return map[string]NPYArray{
+		"id":           {Shape: []int{n}, Int64: ids},
+		"position":     {Shape: []int{n, 2}, Float64: position},
+		"velocity":     {Shape: []int{n, 2}, Float64: velocity},
+		"acceleration": {Shape: []int{n, 2}, Float64: acceleration},
+		"mass":         {Shape: []int{n}, Float64: mass},
+		"step":         {Shape: []int{}, Int64: []int64{int64(header.Step)}},
+		"time":         {Shape: []int{}, Float64: []float64{header.Time}},
+	}
+}
+
+/*
+** Writes a snapshot as a .npz archive of uncompressed arrays, like numpy.savez.
+ */
+func WriteNPZ(w io.Writer, header SnapshotHeader, particles []*Particle) error {
+	arrays := snapshotNPYArrays(header, particles)
+	archive := zip.NewWriter(w)
+	for _, name := range npySnapshotArrays {
+		entry, err := archive.CreateHeader(&zip.FileHeader{Name: name + ".npy", Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		if err := WriteNPY(entry, arrays[name]); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+/*
+** Writes a snapshot to a .npz file, replacing the file.
+ */
+func WriteNPZFile(path string, header SnapshotHeader, particles []*Particle) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := WriteNPZ(file, header, particles); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+/*
+** Writes a snapshot as one .npy file per array, named like snap_position.npy for the
+** path snap.npy.
+ */
+func WriteNPYFiles(path string, header SnapshotHeader, particles []*Particle) error {
+	arrays := snapshotNPYArrays(header, particles)
+	base := strings.TrimSuffix(path, ".npy")
+	for _, name := range npySnapshotArrays {
+		var buf bytes.Buffer
+		if err := WriteNPY(&buf, arrays[name]); err != nil {
+			return err
+		}
+		if err := os.WriteFile(base+"_"+name+".npy", buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+** Reads a snapshot written by WriteNPZ, or by numpy.savez with the same arrays.
+ */
+func ReadNPZFile(path string) (*Snapshot, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	arrays := make(map[string]*NPYArray)
+	for _, file := range archive.File {
+		name := strings.TrimSuffix(file.Name, ".npy")
+		entry, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		array, err := readNPY(entry, int64(file.UncompressedSize64))
+		entry.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, file.Name, err)
+		}
+		arrays[name] = array
+	}
+	snapshot, err := npySnapshot(arrays)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return snapshot, nil
+}
+
+// Checks the arrays of a snapshot and collects them in a Snapshot.
+func npySnapshot(arrays map[string]*NPYArray) (*Snapshot, error) {
+	for _, name := range npySnapshotArrays {
+		if arrays[name] == nil {
+			return nil, fmt.Errorf("missing array %s", name)
+		}
+	}
+	n := arrays["id"].size()
+	for _, name := range npySnapshotArrays {
+		array := arrays[name]
+		var want []int
+		descr := "<f8"
+		switch name {
+		case "id":
+			want, descr = []int{n}, "<i8"
+		case "position", "velocity", "acceleration":
+			want = []int{n, 2}
+		case "mass":
+			want = []int{n}
+		case "step":
+			want, descr = []int{}, "<i8"
+		case "time":
+			want = []int{}
+		}
+		if fmt.Sprint(array.Shape) != fmt.Sprint(want) || array.descr() != descr {
+			return nil, fmt.Errorf("array %s has shape %v of %s, want %v of %s", name, array.Shape, array.descr(), want, descr)
+		}
+	}
+
+	snapshot := &Snapshot{
+		Header: SnapshotHeader{Step: int(arrays["step"].Int64[0]), Time: arrays["time"].Float64[0], Params: make(map[string]string)},
+		ID:     arrays["id"].Int64,
+		Mass:   arrays["mass"].Float64,
+	}
+	for _, pair := range []struct {
+		name string
+		x, y *[]float64
+	}{
+		{"position", &snapshot.X, &snapshot.Y},
+		{"velocity", &snapshot.VX, &snapshot.VY},
+		{"acceleration", &snapshot.AX, &snapshot.AY},
+	} {
+		values := arrays[pair.name].Float64
+		*pair.x, *pair.y = make([]float64, n), make([]float64, n)
+		for i := 0; i < n; i++ {
+			(*pair.x)[i], (*pair.y)[i] = values[2*i], values[2*i+1]
+		}
+	}
+	return snapshot, nil
+}
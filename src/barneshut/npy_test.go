@@ -0,0 +1,98 @@
+package barneshut
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNPYRoundTrip(t *testing.T) {
+	arrays := []NPYArray{
+		{Shape: []int{}, Int64: []int64{-7}},
+		{Shape: []int{}, Float64: []float64{0.25}},
+		{Shape: []int{0}, Int64: []int64{}},
+		{Shape: []int{0, 2}, Float64: []float64{}},
+		{Shape: []int{3}, Int64: []int64{1, -2, 1 << 40}},
+		{Shape: []int{2, 2}, Float64: []float64{1.5, -0, 1e300, -3}},
+	}
+	for _, array := range arrays {
+		var buf bytes.Buffer
+		if err := WriteNPY(&buf, array); err != nil {
+			t.Fatal(err)
+		}
+		if (buf.Len()-8*array.size())%64 != 0 {
+			t.Errorf("shape %v: data does not start at a multiple of 64", array.Shape)
+		}
+		got, err := ReadNPY(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("shape %v: %v", array.Shape, err)
+		}
+		// A scalar reads back with a nil shape.
+		if fmt.Sprint(*got) != fmt.Sprint(array) || (got.Int64 == nil) != (array.Int64 == nil) {
+			t.Errorf("read back %+v, want %+v", *got, array)
+		}
+	}
+}
+
+func TestNPZRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 40} {
+		particles := testParticles(n, 2)
+		for _, p := range particles {
+			p.fx, p.fy = p.vy, -p.vx
+		}
+		header := SnapshotHeader{Step: 12, Time: 1.2}
+		path := filepath.Join(t.TempDir(), "snap.npz")
+		if err := WriteNPZFile(path, header, particles); err != nil {
+			t.Fatal(err)
+		}
+		snapshot, err := ReadNPZFile(path)
+		if err != nil {
+			t.Fatalf("%d particles: %v", n, err)
+		}
+		if snapshot.Len() != n || snapshot.Header.Step != 12 || snapshot.Header.Time != 1.2 {
+			t.Fatalf("%d particles: read back %d, header %+v", n, snapshot.Len(), snapshot.Header)
+		}
+		for i, p := range sortedByID(particles) {
+			got := [8]float64{float64(snapshot.ID[i]), snapshot.X[i], snapshot.Y[i], snapshot.VX[i], snapshot.VY[i], snapshot.AX[i], snapshot.AY[i], snapshot.Mass[i]}
+			want := [8]float64{float64(p.id), p.x, p.y, p.vx, p.vy, p.fx, p.fy, p.mass}
+			if got != want {
+				t.Errorf("%d particles: particle %d read back as %v, want %v", n, i, got, want)
+			}
+		}
+	}
+}
+
+func TestNPYShapeBeyondData(t *testing.T) {
+	header := "{'descr': '<i8', 'fortran_order': False, 'shape': (%s), }"
+	for _, shape := range []string{"4611686018427387904,", "3037000500, 3037000500", "1000,"} {
+		var buf bytes.Buffer
+		buf.WriteString(npyMagic + "\x01\x00")
+		h := strings.Replace(header, "%s", shape, 1) + "\n"
+		buf.Write([]byte{byte(len(h)), byte(len(h) >> 8)})
+		buf.WriteString(h)
+		buf.Write(make([]byte, 64))
+		data := buf.Bytes()
+
+		if _, err := ReadNPY(bytes.NewReader(data)); err == nil {
+			t.Errorf("shape (%s): read 64 bytes of data without error", shape)
+		}
+		// The same in an archive, where the size of the entry bounds the data.
+		path := filepath.Join(t.TempDir(), "bad.npz")
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive := zip.NewWriter(file)
+		entry, _ := archive.Create("id.npy")
+		entry.Write(data)
+		archive.Close()
+		file.Close()
+		if _, err := ReadNPZFile(path); err == nil || !strings.Contains(err.Error(), "shape") {
+			t.Errorf("shape (%s): archive read with error %v", shape, err)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package barneshut
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Most particles in a leaf of the ParticleSet tree, and particles per task in Step.
+const (
+	setLeafSize  = 8
+	setChunkSize = 256
+)
+
+/*
+** Structure-of-arrays particle storage. Particle i is (x[i], y[i], ...), kept in
+** Morton (Z-order) order so particles that are close in space are close in memory
+** and every tree node owns a contiguous range of them.
+ */
+type ParticleSet struct {
+	x, y, vx, vy, ax, ay, mass []float64
+	index                      []int32 // Position of particle i in the slice it was created from.
+
+	keys []uint64
+	tree setTree
+	walk string // One of the Walk* modes.
+
+	// Tree nodes opened or used, and interactions summed, by the last Step.
+	visits, interactions int64
+}
+
+/*
+** The quadtree over a Morton-sorted ParticleSet, itself stored as arrays indexed by node.
+** Node 0 is the root. A node without children is a leaf owning particles [start, end).
+ */
+type setTree struct {
+	comX, comY, mass, size []float64
+	start, end             []int32
+	children               [][4]int32 // -1 for missing children.
+	parent                 []int32    // -1 for the root.
+}
+
+/*
+** Copies the particles into a new set.
+ */
+func NewParticleSet(particles []*Particle) *ParticleSet {
+	n := len(particles)
+	set := &ParticleSet{
+		x: make([]float64, n), y: make([]float64, n),
+		vx: make([]float64, n), vy: make([]float64, n),
+		ax: make([]float64, n), ay: make([]float64, n),
+		mass:  make([]float64, n),
+		index: make([]int32, n),
+		keys:  make([]uint64, n),
+	}
+	for i, p := range particles {
+		set.x[i], set.y[i], set.vx[i], set.vy[i] = p.x, p.y, p.vx, p.vy
+		set.ax[i], set.ay[i], set.mass[i] = p.fx, p.fy, p.mass
+		set.index[i] = int32(i)
+	}
+	return set
+}
+
+func (set *ParticleSet) Len() int {
+	return len(set.x)
+}
+
+/*
+** Copies the state back into the particles the set was created from.
+ */
+func (set *ParticleSet) Store(particles []*Particle) {
+	for i, original := range set.index {
+		p := particles[original]
+		p.x, p.y, p.vx, p.vy = set.x[i], set.y[i], set.vx[i], set.vy[i]
+		p.fx, p.fy, p.mass = set.ax[i], set.ay[i], set.mass[i]
+	}
+}
+
+/*
+** Runs one time-step on numThreads threads: sort, build the tree, then the force
+** walk selected by SetWalk and the position update.
+ */
+func (set *ParticleSet) Step(dt float64, numThreads int) {
+	set.sortMorton()
+	set.buildTree()
+	set.visits, set.interactions = 0, 0
+
+	switch set.walk {
+	case WalkGroup:
+		set.groupForces(numThreads)
+	case WalkDualTree:
+		set.dualTreeForces(numThreads)
+	default:
+		set.parallelChunks(set.Len(), numThreads, func(start, end int) {
+			var list interactionList
+			var visits, interactions int64
+			for i := start; i < end; i++ {
+				list.reset()
+				visits += set.tree.walk(set, i, &list)
+				interactions += int64(len(list.x))
+				set.ax[i], set.ay[i] = accumulateForce(set.x[i], set.y[i], list.x, list.y, list.mass)
+			}
+			set.addWalkStats(visits, interactions)
+		})
+	}
+
+	set.parallelChunks(set.Len(), numThreads, func(start, end int) {
+		for i := start; i < end; i++ {
+			set.vx[i] += dt * set.ax[i]
+			set.vy[i] += dt * set.ay[i]
+			set.x[i] += set.vx[i] * dt
+			set.y[i] += set.vy[i] * dt
+		}
+	})
+}
+
+/*
+** Runs fn over [0, n) on numThreads threads, in chunks handed out by an atomic counter.
+ */
+func (set *ParticleSet) parallelChunks(n int, numThreads int, fn func(start, end int)) {
+	var next int64 = 0
+	var wg sync.WaitGroup
+	for t := 0; t < max(1, numThreads); t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				start := int(atomic.AddInt64(&next, setChunkSize)) - setChunkSize
+				if start >= n {
+					return
+				}
+				fn(start, min(start+setChunkSize, n))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (set *ParticleSet) addWalkStats(visits, interactions int64) {
+	atomic.AddInt64(&set.visits, visits)
+	atomic.AddInt64(&set.interactions, interactions)
+}
+
+/*
+** Tree nodes visited by the force walks and interactions summed in the last Step.
+ */
+func (set *ParticleSet) WalkStats() (visits int64, interactions int64) {
+	return set.visits, set.interactions
+}
+
+/*
+** Sorts the set by the Morton key of the positions in their bounding square.
+ */
+func (set *ParticleSet) sortMorton() {
+	n := set.Len()
+	if n == 0 {
+		return
+	}
+	minX, minY, size := set.boundingSquare()
+	scale := float64(math.MaxUint32) / size
+	for i := 0; i < n; i++ {
+		set.keys[i] = mortonKey(uint32((set.x[i]-minX)*scale), uint32((set.y[i]-minY)*scale))
+	}
+
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return set.keys[order[a]] < set.keys[order[b]] })
+
+	keys := make([]uint64, n)
+	index := make([]int32, n)
+	for i, from := range order {
+		keys[i], index[i] = set.keys[from], set.index[from]
+	}
+	set.keys, set.index = keys, index
+	for _, column := range []*[]float64{&set.x, &set.y, &set.vx, &set.vy, &set.ax, &set.ay, &set.mass} {
+		sorted := make([]float64, n)
+		for i, from := range order {
+			sorted[i] = (*column)[from]
+		}
+		*column = sorted
+	}
+}
+
+// Lower left corner and width of the smallest square holding every particle.
+func (set *ParticleSet) boundingSquare() (float64, float64, float64) {
+	minX, maxX, minY, maxY := set.x[0], set.x[0], set.y[0], set.y[0]
+	for i := 1; i < set.Len(); i++ {
+		minX, maxX = min(minX, set.x[i]), max(maxX, set.x[i])
+		minY, maxY = min(minY, set.y[i]), max(maxY, set.y[i])
+	}
+	size := max(maxX-minX, maxY-minY)
+	if size == 0 {
+		size = 1
+	}
+	// Keep the largest coordinate strictly inside the square.
+	return minX, minY, size * (1 + 1e-9)
+}
+
+// Interleaves the bits of x and y, x in the even bits.
+func mortonKey(x, y uint32) uint64 {
+	return spreadBits(x) | spreadBits(y)<<1
+}
+
+func spreadBits(v uint32) uint64 {
+	x := uint64(v)
+	x = (x | x<<16) & 0x0000FFFF0000FFFF
+	x = (x | x<<8) & 0x00FF00FF00FF00FF
+	x = (x | x<<4) & 0x0F0F0F0F0F0F0F0F
+	x = (x | x<<2) & 0x3333333333333333
+	x = (x | x<<1) & 0x5555555555555555
+	return x
+}
+
+/*
+** Builds the tree over the sorted set. The two key bits of a level pick the child,
+** so each child is a contiguous subrange found by binary search.
+ */
+func (set *ParticleSet) buildTree() {
+	tree := &set.tree
+	tree.comX, tree.comY, tree.mass, tree.size = tree.comX[:0], tree.comY[:0], tree.mass[:0], tree.size[:0]
+	tree.start, tree.end, tree.children = tree.start[:0], tree.end[:0], tree.children[:0]
+	tree.parent = tree.parent[:0]
+	if set.Len() == 0 {
+		return
+	}
+	_, _, size := set.boundingSquare()
+	set.buildNode(-1, 0, int32(set.Len()), 31, size)
+}
+
+func (set *ParticleSet) buildNode(parent, start, end int32, level int, size float64) int32 {
+	tree := &set.tree
+	node := int32(len(tree.start))
+	tree.parent = append(tree.parent, parent)
+	tree.start = append(tree.start, start)
+	tree.end = append(tree.end, end)
+	tree.size = append(tree.size, size)
+	tree.children = append(tree.children, [4]int32{-1, -1, -1, -1})
+	tree.comX = append(tree.comX, 0)
+	tree.comY = append(tree.comY, 0)
+	tree.mass = append(tree.mass, 0)
+
+	var mass, comX, comY float64
+	if end-start <= setLeafSize || level < 0 {
+		for i := start; i < end; i++ {
+			mass += set.mass[i]
+			comX += set.x[i] * set.mass[i]
+			comY += set.y[i] * set.mass[i]
+		}
+	} else {
+		shift := uint(2 * level)
+		lo := start
+		for quadrant := uint64(0); quadrant < 4; quadrant++ {
+			hi := start + int32(sort.Search(int(end-start), func(k int) bool {
+				return (set.keys[start+int32(k)]>>shift)&3 > quadrant
+			}))
+			if hi > lo {
+				child := set.buildNode(node, lo, hi, level-1, size/2)
+				tree.children[node][quadrant] = child
+				mass += tree.mass[child]
+				comX += tree.comX[child] * tree.mass[child]
+				comY += tree.comY[child] * tree.mass[child]
+			}
+			lo = hi
+		}
+	}
+	tree.mass[node] = mass
+	if mass > 0 {
+		tree.comX[node], tree.comY[node] = comX/mass, comY/mass
+	}
+	return node
+}
+
+func (tree *setTree) isLeaf(node int32) bool {
+	return tree.children[node] == [4]int32{-1, -1, -1, -1}
+}
+
+/*
+** The sources acting on one particle, gathered by the tree walk so that the force
+** is summed in one loop over contiguous arrays.
+ */
+type interactionList struct {
+	x, y, mass []float64
+}
+
+func (list *interactionList) reset() {
+	list.x, list.y, list.mass = list.x[:0], list.y[:0], list.mass[:0]
+}
+
+func (list *interactionList) add(x, y, mass float64) {
+	list.x = append(list.x, x)
+	list.y = append(list.y, y)
+	list.mass = append(list.mass, mass)
+}
+
+/*
+** Collects the interactions of particle i with the same s/D < THETA criterion as
+** ForceCalculation. Opened leaves add their particles, except i itself.
+** Returns the number of nodes visited.
+ */
+func (tree *setTree) walk(set *ParticleSet, i int, list *interactionList) int64 {
+	var stack [128]int32
+	var visits int64 = 0
+	top := 0
+	stack[top] = 0
+	top++
+	for top > 0 {
+		top--
+		node := stack[top]
+		visits++
+		dx := set.x[i] - tree.comX[node]
+		dy := set.y[i] - tree.comY[node]
+		D := math.Sqrt(dx*dx + dy*dy + SOFTENING)
+		owns := tree.start[node] <= int32(i) && int32(i) < tree.end[node]
+
+		if !owns && tree.size[node]/D < THETA {
+			list.add(tree.comX[node], tree.comY[node], tree.mass[node])
+		} else if tree.isLeaf(node) {
+			for j := tree.start[node]; j < tree.end[node]; j++ {
+				if j != int32(i) {
+					list.add(set.x[j], set.y[j], set.mass[j])
+				}
+			}
+		} else {
+			for _, child := range tree.children[node] {
+				if child >= 0 {
+					stack[top] = child
+					top++
+				}
+			}
+		}
+	}
+	return visits
+}
+
+/*
+** The force kernel: acceleration at (x, y) due to the sources. A branch-free loop
+** over equal-length slices, with the bounds checks hoisted out of the loop.
+ */
+func accumulateForce(x, y float64, srcX, srcY, srcMass []float64) (float64, float64) {
+	srcY = srcY[:len(srcX)]
+	srcMass = srcMass[:len(srcX)]
+	var ax, ay float64
+	for k := range srcX {
+		dx := srcX[k] - x
+		dy := srcY[k] - y
+		distSqr := dx*dx + dy*dy + SOFTENING
+		invDist := 1.0 / math.Sqrt(distSqr)
+		invDist3 := invDist * invDist * invDist
+		ax += dx * srcMass[k] * invDist3
+		ay += dy * srcMass[k] * invDist3
+	}
+	return ax, ay
+}
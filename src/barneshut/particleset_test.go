@@ -0,0 +1,116 @@
+package barneshut
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+)
+
+// The accelerations of the direct O(N^2) sum, with the softening of the force walks.
+func directAccelerations(particles []*Particle) (ax, ay []float64) {
+	ax, ay = make([]float64, len(particles)), make([]float64, len(particles))
+	for i, p := range particles {
+		for j, q := range particles {
+			if i == j {
+				continue
+			}
+			dx, dy := q.x-p.x, q.y-p.y
+			invDist := 1 / math.Sqrt(dx*dx+dy*dy+SOFTENING)
+			ax[i] += dx * q.mass * invDist * invDist * invDist
+			ay[i] += dy * q.mass * invDist * invDist * invDist
+		}
+	}
+	return ax, ay
+}
+
+/*
+** The 99th percentile and the median of the relative error of the accelerations of
+** the particles against the direct sum. The largest error is left out: it is that of
+** a particle whose forces nearly cancel, however small the error of the sum.
+ */
+func forceErrors(particles []*Particle, ax, ay []float64) (p99, median float64) {
+	errs := make([]float64, len(particles))
+	for i, p := range particles {
+		errs[i] = math.Hypot(p.fx-ax[i], p.fy-ay[i]) / math.Hypot(ax[i], ay[i])
+	}
+	sort.Float64s(errs)
+	return errs[len(errs)*99/100], errs[len(errs)/2]
+}
+
+// Computes the accelerations with the tree layout, without moving the particles.
+func treeAccelerations(particles []*Particle) {
+	sched, _ := NewScheduler(SchedulerOptions{Name: SchedulerSequential})
+	RunSimulation(newTree(particles), sched, 0, len(particles))
+}
+
+// Computes the accelerations with a ParticleSet and the walk, without moving the particles.
+func setAccelerations(particles []*Particle, walk string, numThreads int) *ParticleSet {
+	set := NewParticleSet(particles)
+	set.SetWalk(walk)
+	set.Step(0, numThreads)
+	set.Store(particles)
+	return set
+}
+
+/*
+** Both layouts use the opening criterion s/D < THETA on different trees, the tree
+** layout on a root spanning the int64 range and the set on the bounding square with
+** leaf buckets, so neither matches the direct sum or the other exactly.
+ */
+func TestParticleSetForces(t *testing.T) {
+	particles := testParticles(5000, 5)
+	ax, ay := directAccelerations(particles)
+
+	treeAccelerations(particles)
+	treeP99, treeMedian := forceErrors(particles, ax, ay)
+	for _, numThreads := range []int{1, 4} {
+		setAccelerations(particles, WalkParticle, numThreads)
+		setP99, setMedian := forceErrors(particles, ax, ay)
+		t.Logf("%d threads: 99th percentile error tree %.3g soa %.3g, median tree %.3g soa %.3g", numThreads, treeP99, setP99, treeMedian, setMedian)
+		if setP99 > 0.1 || setMedian > 0.01 {
+			t.Errorf("%d threads: 99th percentile error %.3g, median %.3g against the direct sum", numThreads, setP99, setMedian)
+		}
+		if setP99 > 1.2*treeP99 || setMedian > 1.2*treeMedian {
+			t.Errorf("%d threads: errors %.3g and %.3g, the tree layout's are %.3g and %.3g", numThreads, setP99, setMedian, treeP99, treeMedian)
+		}
+	}
+}
+
+func TestParticleSetStep(t *testing.T) {
+	particles := testParticles(500, 6)
+	set := NewParticleSet(particles)
+	set.Step(1, 2)
+	moved := testParticles(500, 6)
+	set.Store(moved)
+	// The set is sorted by the step, but Store puts every particle back in its place.
+	for i, p := range moved {
+		want := particles[i]
+		if p.id != want.id || p.mass != want.mass || p.x != want.x+p.vx || p.y != want.y+p.vy || p.vx != want.vx+p.fx || p.vy != want.vy+p.fy {
+			t.Fatalf("particle %d: %+v after a step from %+v", i, *p, *want)
+		}
+	}
+}
+
+/*
+** One time-step in each layout on 1 thread, building the tree included:
+**
+**	go test -bench=Layout ./src/barneshut
+ */
+func BenchmarkLayout(b *testing.B) {
+	for _, n := range []int{5000, 20000} {
+		b.Run(fmt.Sprintf("tree/%d", n), func(b *testing.B) {
+			sched, _ := NewScheduler(SchedulerOptions{Name: SchedulerSequential})
+			particles := testParticles(n, 1)
+			for i := 0; i < b.N; i++ {
+				RunSimulation(newTree(particles), sched, 1, n)
+			}
+		})
+		b.Run(fmt.Sprintf("soa/%d", n), func(b *testing.B) {
+			set := NewParticleSet(testParticles(n, 1))
+			for i := 0; i < b.N; i++ {
+				set.Step(1, 1)
+			}
+		})
+	}
+}
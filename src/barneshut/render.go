@@ -0,0 +1,225 @@
+package barneshut
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// What RenderOptions.Color colors the particles by.
+const (
+	ColorUniform = ""      // A single color.
+	ColorSpeed   = "speed" // The speed, on a linear scale.
+	ColorMass    = "mass"  // The mass, on a log scale.
+)
+
+/*
+** How RenderParticles draws a frame. The zero value draws 800x800 pixels of the
+** particles' bounds, one pixel per particle, in a single color.
+ */
+type RenderOptions struct {
+	Width, Height          int     // Pixels, 800 if 0.
+	MinX, MaxX, MinY, MaxY float64 // Viewport, the bounds of the particles with a margin if empty.
+	PointSize              int     // Diameter of a particle in pixels, 1 if 0.
+	Color                  string  // One of the Color* constants.
+	Density                bool    // Shade the pixels by the log of the number of particles on them.
+}
+
+// The color of a uniform frame, matplotlib's tab:blue, and of the background.
+var (
+	renderUniform    = color.RGBA{R: 31, G: 119, B: 180, A: 255}
+	renderBackground = color.RGBA{A: 255}
+)
+
+// Control points of the viridis colormap, evenly spaced from 0 to 1.
+var viridis = []color.RGBA{
+	{R: 68, G: 1, B: 84, A: 255},
+	{R: 59, G: 82, B: 139, A: 255},
+	{R: 33, G: 145, B: 140, A: 255},
+	{R: 94, G: 201, B: 98, A: 255},
+	{R: 253, G: 231, B: 37, A: 255},
+}
+
+// The colormap at t in [0, 1].
+func colormap(t float64) color.RGBA {
+	t = min(max(t, 0), 1) * float64(len(viridis)-1)
+	i := min(int(t), len(viridis)-2)
+	f := t - float64(i)
+	lerp := func(a, b uint8) uint8 { return uint8(math.Round(float64(a) + f*(float64(b)-float64(a)))) }
+	a, b := viridis[i], viridis[i+1]
+	return color.RGBA{R: lerp(a.R, b.R), G: lerp(a.G, b.G), B: lerp(a.B, b.B), A: 255}
+}
+
+/*
+** Rasterizes the particles, y up, on a black background. A pixel covered by several
+** particles gets the color of their mean value. With Density the brightness of that
+** color goes with the log of their number, or without a Color the colormap does, so
+** dense regions stand out instead of saturating.
+** The particles are drawn in ID order, so a frame does not depend on the layout or the
+** scheduler.
+ */
+func RenderParticles(particles []*Particle, opts RenderOptions) *image.RGBA {
+	opts = opts.FitViewport(particles)
+	width, height := opts.Width, opts.Height
+	minX, maxX, minY, maxY := opts.MinX, opts.MaxX, opts.MinY, opts.MaxY
+	sorted := sortedByID(particles)
+
+	// The value of every particle, scaled to [0, 1] between the 1st and 99th percentiles
+	// so a few outliers do not squeeze the colors of the others.
+	values := make([]float64, len(sorted))
+	if (opts.Color == ColorSpeed || opts.Color == ColorMass) && len(sorted) > 0 {
+		for i, p := range sorted {
+			if opts.Color == ColorSpeed {
+				values[i] = math.Hypot(p.vx, p.vy)
+			} else {
+				values[i] = math.Log(p.mass)
+			}
+		}
+		ordered := slices.Clone(values)
+		slices.Sort(ordered)
+		lo, hi := ordered[len(ordered)/100], ordered[(len(ordered)-1)*99/100]
+		for i := range values {
+			if hi > lo {
+				values[i] = (values[i] - lo) / (hi - lo)
+			} else {
+				values[i] = 0.5
+			}
+		}
+	}
+
+	// The number of particles on every pixel and the sum of their values.
+	counts := make([]float64, width*height)
+	sums := make([]float64, width*height)
+	size := max(opts.PointSize, 1)
+	radius := float64(size) / 2
+	for i, p := range sorted {
+		px := (p.x - minX) / (maxX - minX) * float64(width)
+		py := (maxY - p.y) / (maxY - minY) * float64(height)
+		if math.IsNaN(px) || math.IsNaN(py) {
+			continue
+		}
+		// The pixels whose centers lie within the point, at least the one under it.
+		x0, y0 := int(math.Floor(px-radius+0.5)), int(math.Floor(py-radius+0.5))
+		for y := y0; y < y0+size; y++ {
+			for x := x0; x < x0+size; x++ {
+				dx, dy := float64(x)+0.5-px, float64(y)+0.5-py
+				if size > 2 && dx*dx+dy*dy > radius*radius {
+					continue
+				}
+				if x < 0 || x >= width || y < 0 || y >= height {
+					continue
+				}
+				counts[y*width+x]++
+				sums[y*width+x] += values[i]
+			}
+		}
+	}
+
+	maxCount := 0.0
+	for _, count := range counts {
+		maxCount = max(maxCount, count)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for k, count := range counts {
+		c := renderBackground
+		density := math.Log1p(count) / math.Log1p(maxCount)
+		switch {
+		case count == 0:
+		case opts.Color != ColorUniform && opts.Density:
+			// At least 40% bright, so single particles stay visible.
+			c = colormap(sums[k] / count)
+			f := 0.4 + 0.6*density
+			c = color.RGBA{R: uint8(float64(c.R) * f), G: uint8(float64(c.G) * f), B: uint8(float64(c.B) * f), A: 255}
+		case opts.Color != ColorUniform:
+			c = colormap(sums[k] / count)
+		case opts.Density:
+			c = colormap(density)
+		default:
+			c = renderUniform
+		}
+		img.SetRGBA(k%width, k/width, c)
+	}
+	return img
+}
+
+/*
+** The options with the default size, and with the viewport set to the bounds of the
+** particles if it is empty: with a 5% margin and widened to the aspect ratio of the
+** frame so the pixels are square. A sequence of frames fits the viewport once, so it
+** does not jump from frame to frame.
+ */
+func (opts RenderOptions) FitViewport(particles []*Particle) RenderOptions {
+	if opts.Width <= 0 {
+		opts.Width = 800
+	}
+	if opts.Height <= 0 {
+		opts.Height = 800
+	}
+	if opts.MinX < opts.MaxX && opts.MinY < opts.MaxY {
+		return opts
+	}
+	aspect := float64(opts.Width) / float64(opts.Height)
+	bounds := rankBounds{MinX: -1, MaxX: 1, MinY: -1, MaxY: 1}
+	if len(particles) > 0 {
+		bounds = particleBounds(particles)
+	}
+	centerX, centerY := (bounds.MinX+bounds.MaxX)/2, (bounds.MinY+bounds.MaxY)/2
+	halfWidth := max((bounds.MaxX-bounds.MinX)/2, (bounds.MaxY-bounds.MinY)/2*aspect) * 1.05
+	if halfWidth == 0 {
+		halfWidth = 1
+	}
+	halfHeight := halfWidth / aspect
+	opts.MinX, opts.MaxX = centerX-halfWidth, centerX+halfWidth
+	opts.MinY, opts.MaxY = centerY-halfHeight, centerY+halfHeight
+	return opts
+}
+
+/*
+** Render options from their command-line forms: the size as WIDTHxHEIGHT and the
+** viewport as minX,maxX,minY,maxY, or empty to fit the particles.
+ */
+func ParseRenderOptions(size string, view string, point int, colorBy string, density bool) (RenderOptions, error) {
+	opts := RenderOptions{PointSize: point, Color: colorBy, Density: density}
+	if _, err := fmt.Sscanf(size, "%dx%d", &opts.Width, &opts.Height); err != nil || opts.Width <= 0 || opts.Height <= 0 {
+		return opts, fmt.Errorf("invalid size %q, want WIDTHxHEIGHT", size)
+	}
+	if view != "" {
+		fields := strings.Split(view, ",")
+		bounds := make([]float64, len(fields))
+		for i, field := range fields {
+			var err error
+			if bounds[i], err = strconv.ParseFloat(strings.TrimSpace(field), 64); err != nil {
+				return opts, fmt.Errorf("invalid viewport %q: %w", view, err)
+			}
+		}
+		if len(bounds) != 4 || bounds[0] >= bounds[1] || bounds[2] >= bounds[3] {
+			return opts, fmt.Errorf("invalid viewport %q, want minX,maxX,minY,maxY", view)
+		}
+		opts.MinX, opts.MaxX, opts.MinY, opts.MaxY = bounds[0], bounds[1], bounds[2], bounds[3]
+	}
+	if colorBy != ColorUniform && colorBy != ColorSpeed && colorBy != ColorMass {
+		return opts, fmt.Errorf("unknown color %q, want speed or mass", colorBy)
+	}
+	return opts, nil
+}
+
+/*
+** Renders the particles to a PNG file, replacing the file.
+ */
+func WritePNGFrame(path string, particles []*Particle, opts RenderOptions) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, RenderParticles(particles, opts)); err != nil {
+		file.Close()
+		return fmt.Errorf("encoding %s: %w", path, err)
+	}
+	return file.Close()
+}
@@ -0,0 +1,12 @@
+package barneshut
+
+import "testing"
+
+func TestRenderParticlesEmpty(t *testing.T) {
+	for _, color := range []string{ColorUniform, ColorSpeed, ColorMass} {
+		img := RenderParticles(nil, RenderOptions{Width: 16, Height: 8, Color: color, Density: true})
+		if img.Bounds().Dx() != 16 || img.Bounds().Dy() != 8 {
+			t.Errorf("color %q: rendered %v", color, img.Bounds())
+		}
+	}
+}
@@ -0,0 +1,516 @@
+package barneshut
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Names of the available parallel strategies.
+const (
+	SchedulerSequential   = "sequential"
+	SchedulerGoroutine    = "goroutine"
+	SchedulerWorkStealing = "worksteal"
+	SchedulerStatic       = "static"
+	SchedulerCostzones    = "costzones"
+)
+
+/*
+** A Scheduler decides how the supersteps of a time-step are spread over the threads.
+** CenterOfMass is the bottom-up superstep, ForEachParticle runs fn once for every
+** particle in the tree (velocity and position updates).
+** Worker t only writes counters[t], which has one entry per thread.
+** When ctx is done the workers stop between tasks and the superstep is left unfinished.
+**
+** Results must not depend on the scheduler or the thread count: a node's COM is
+** always reduced from its children in tree order (setCenterOfMass) and each
+** particle is handled by exactly one worker, so any scheduler with any number of
+** threads gives output bit-identical to the sequential run.
+ */
+type Scheduler interface {
+	Name() string
+	NumThreads() int
+	CenterOfMass(ctx context.Context, root *BarnesHutNode, counters []WorkerCounters)
+	ForEachParticle(ctx context.Context, root *BarnesHutNode, nParticles int, fn func(*Particle), counters []WorkerCounters)
+}
+
+type SchedulerOptions struct {
+	Name       string // One of the Scheduler* names, defaults to work stealing.
+	NumThreads int    // Defaults to 1.
+
+	// Work stealing only.
+	Victim     string // One of the Victim* policies, defaults to round-robin.
+	BatchSteal bool   // Steal half of the victim's deque at once.
+
+	// Subtrees with at most SubtreeCutoff particles, or at DepthCutoff or deeper, are a
+	// single task run sequentially by the worker that takes it. A SubtreeCutoff of 0
+	// is tuned from the particle and thread counts, -1 makes every node a task.
+	// A DepthCutoff of 0 disables the depth limit.
+	SubtreeCutoff int
+	DepthCutoff   int
+}
+
+/*
+** Creates the scheduler selected by the options.
+ */
+func NewScheduler(opts SchedulerOptions) (Scheduler, error) {
+	numThreads := opts.NumThreads
+	if numThreads < 1 {
+		numThreads = 1
+	}
+	if err := validVictimPolicy(opts.Victim); err != nil {
+		return nil, err
+	}
+	switch opts.Name {
+	case SchedulerSequential:
+		return &sequentialScheduler{}, nil
+	case SchedulerGoroutine:
+		return &goroutineScheduler{numThreads: numThreads}, nil
+	case SchedulerWorkStealing, "":
+		return &workStealingScheduler{
+			numThreads:    numThreads,
+			victim:        opts.Victim,
+			batch:         opts.BatchSteal,
+			subtreeCutoff: opts.SubtreeCutoff,
+			depthCutoff:   opts.DepthCutoff,
+		}, nil
+	case SchedulerStatic:
+		return &staticScheduler{numThreads: numThreads}, nil
+	case SchedulerCostzones:
+		return &costzonesScheduler{numThreads: numThreads}, nil
+	}
+	return nil, fmt.Errorf("unknown scheduler %q", opts.Name)
+}
+
+/*
+** Sequential: plain recursive traversals on the calling thread.
+ */
+type sequentialScheduler struct{}
+
+func (s *sequentialScheduler) Name() string    { return SchedulerSequential }
+func (s *sequentialScheduler) NumThreads() int { return 1 }
+
+func (s *sequentialScheduler) CenterOfMass(ctx context.Context, root *BarnesHutNode, counters []WorkerCounters) {
+	start := time.Now()
+	walk(ctx.Done(), root, nil, setCenterOfMass, &counters[0])
+	counters[0].Busy += time.Since(start)
+}
+
+func (s *sequentialScheduler) ForEachParticle(ctx context.Context, root *BarnesHutNode, nParticles int, fn func(*Particle), counters []WorkerCounters) {
+	start := time.Now()
+	walk(ctx.Done(), root, visitParticle(fn), nil, &counters[0])
+	counters[0].Busy += time.Since(start)
+}
+
+/*
+** Goroutine per subtree: a child subtree gets its own goroutine while a thread is
+** free, otherwise the current goroutine recurses into it.
+ */
+type goroutineScheduler struct {
+	numThreads int
+}
+
+func (s *goroutineScheduler) Name() string    { return SchedulerGoroutine }
+func (s *goroutineScheduler) NumThreads() int { return s.numThreads }
+
+func (s *goroutineScheduler) CenterOfMass(ctx context.Context, root *BarnesHutNode, counters []WorkerCounters) {
+	walkSpawningFrom(ctx.Done(), root, nil, setCenterOfMass, s.numThreads, counters)
+}
+
+func (s *goroutineScheduler) ForEachParticle(ctx context.Context, root *BarnesHutNode, nParticles int, fn func(*Particle), counters []WorkerCounters) {
+	walkSpawningFrom(ctx.Done(), root, visitParticle(fn), nil, s.numThreads, counters)
+}
+
+/*
+** Work stealing: the original strategy. COM uses the goroutine spawning model and
+** the per-particle supersteps are distributed through the deques.
+ */
+type workStealingScheduler struct {
+	numThreads    int
+	victim        string
+	batch         bool
+	subtreeCutoff int
+	depthCutoff   int
+}
+
+func (s *workStealingScheduler) Name() string    { return SchedulerWorkStealing }
+func (s *workStealingScheduler) NumThreads() int { return s.numThreads }
+
+func (s *workStealingScheduler) CenterOfMass(ctx context.Context, root *BarnesHutNode, counters []WorkerCounters) {
+	walkSpawningFrom(ctx.Done(), root, nil, setCenterOfMass, s.numThreads, counters)
+}
+
+func (s *workStealingScheduler) ForEachParticle(ctx context.Context, root *BarnesHutNode, nParticles int, fn func(*Particle), counters []WorkerCounters) {
+	var wg sync.WaitGroup
+	var tasksProcessed int32 = 0
+
+	deques := make([]*Deque, s.numThreads)
+	for i := 0; i < s.numThreads; i++ {
+		deques[i] = NewDeque()
+	}
+	deques[0].PushFront(Task{Node: root})
+
+	cutoff := subtreeCutoff{size: int32(s.subtreeCutoff), depth: s.depthCutoff}
+	if s.subtreeCutoff == 0 {
+		cutoff.size = int32(AutoSubtreeCutoff(nParticles, s.numThreads))
+	}
+
+	wg.Add(s.numThreads)
+	for t := 0; t < s.numThreads; t++ {
+		go func(threadNum int) {
+			defer wg.Done()
+			thief := newThief(threadNum, s.numThreads, s.victim, s.batch)
+			stealingWorker(ctx.Done(), fn, thief, deques, &tasksProcessed, nParticles, cutoff, &counters[threadNum])
+		}(t)
+	}
+	wg.Wait()
+}
+
+/*
+** Static chunking: the particles are listed in tree order and split into numThreads
+** contiguous chunks of equal length, one per thread. No balancing at runtime.
+ */
+type staticScheduler struct {
+	numThreads int
+}
+
+func (s *staticScheduler) Name() string    { return SchedulerStatic }
+func (s *staticScheduler) NumThreads() int { return s.numThreads }
+
+func (s *staticScheduler) CenterOfMass(ctx context.Context, root *BarnesHutNode, counters []WorkerCounters) {
+	calcCenterOfMassStatic(ctx.Done(), root, s.numThreads, counters)
+}
+
+func (s *staticScheduler) ForEachParticle(ctx context.Context, root *BarnesHutNode, nParticles int, fn func(*Particle), counters []WorkerCounters) {
+	particles := collectParticles(root, nParticles)
+	bounds := make([]int, s.numThreads+1)
+	for t := 0; t <= s.numThreads; t++ {
+		bounds[t] = t * len(particles) / s.numThreads
+	}
+	runChunks(ctx.Done(), particles, bounds, fn, counters)
+}
+
+/*
+** Costzones: like static chunking, but the tree-ordered particle list is cut into
+** zones of equal cost, where the cost of a particle is the number of interactions
+** it needed in the previous force calculation.
+ */
+type costzonesScheduler struct {
+	numThreads int
+}
+
+func (s *costzonesScheduler) Name() string    { return SchedulerCostzones }
+func (s *costzonesScheduler) NumThreads() int { return s.numThreads }
+
+func (s *costzonesScheduler) CenterOfMass(ctx context.Context, root *BarnesHutNode, counters []WorkerCounters) {
+	calcCenterOfMassStatic(ctx.Done(), root, s.numThreads, counters)
+}
+
+func (s *costzonesScheduler) ForEachParticle(ctx context.Context, root *BarnesHutNode, nParticles int, fn func(*Particle), counters []WorkerCounters) {
+	particles := collectParticles(root, nParticles)
+	var totalCost int64 = 0
+	for _, p := range particles {
+		totalCost += particleCost(p)
+	}
+
+	// Cut the list where the running cost crosses each multiple of totalCost/numThreads.
+	bounds := make([]int, s.numThreads+1)
+	var cost int64 = 0
+	zone := 1
+	for i, p := range particles {
+		for zone < s.numThreads && cost*int64(s.numThreads) >= totalCost*int64(zone) {
+			bounds[zone] = i
+			zone++
+		}
+		cost += particleCost(p)
+	}
+	for ; zone <= s.numThreads; zone++ {
+		bounds[zone] = len(particles)
+	}
+	runChunks(ctx.Done(), particles, bounds, fn, counters)
+}
+
+// Subtree tasks per thread aimed for by AutoSubtreeCutoff, enough for stealing to balance the load.
+const subtreeTasksPerThread = 32
+
+/*
+** The SubtreeCutoff used when it is 0: the largest subtree size that still leaves
+** about subtreeTasksPerThread tasks for each thread.
+ */
+func AutoSubtreeCutoff(nParticles int, numThreads int) int {
+	return max(1, nParticles/(numThreads*subtreeTasksPerThread))
+}
+
+type subtreeCutoff struct {
+	size  int32 // Largest subtree, in particles, run as one task. -1 for none.
+	depth int   // Depth from which subtrees are run as one task. 0 for none.
+}
+
+func (cutoff subtreeCutoff) sequential(node *BarnesHutNode, depth int) bool {
+	return node.nParticles <= cutoff.size || (cutoff.depth > 0 && depth >= cutoff.depth)
+}
+
+// Particles that were never through a force calculation count as one interaction.
+func particleCost(p *Particle) int64 {
+	if p.interactions > 0 {
+		return int64(p.interactions)
+	}
+	return 1
+}
+
+/*
+** Helpers shared by the schedulers.
+ */
+
+func visitParticle(fn func(*Particle)) func(*BarnesHutNode) {
+	return func(node *BarnesHutNode) {
+		if node.particle != nil {
+			fn(node.particle)
+		}
+	}
+}
+
+/*
+** Sequential preorder/postorder traversal, counting every node as a task.
+** Either visit or post may be nil.
+ */
+func walk(done <-chan struct{}, node *BarnesHutNode, visit, post func(*BarnesHutNode), counters *WorkerCounters) {
+	if node == nil || cancelled(done) {
+		return
+	}
+	counters.Tasks++
+	if visit != nil {
+		visit(node)
+	}
+	for _, child := range node.quadrants() {
+		walk(done, child, visit, post, counters)
+	}
+	if post != nil {
+		post(node)
+	}
+}
+
+// Non-blocking check of a context's Done channel, a nil channel is never done.
+func cancelled(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+** Free worker ids for the goroutine spawning model. The calling goroutine is
+** worker 0 and never in the pool.
+ */
+type threadPool struct {
+	free chan int
+}
+
+func newThreadPool(numThreads int) *threadPool {
+	pool := &threadPool{free: make(chan int, numThreads)}
+	for t := 1; t < numThreads; t++ {
+		pool.free <- t
+	}
+	return pool
+}
+
+func (pool *threadPool) tryAcquire() (int, bool) {
+	select {
+	case worker := <-pool.free:
+		return worker, true
+	default:
+		return 0, false
+	}
+}
+
+func (pool *threadPool) release(worker int) {
+	pool.free <- worker
+}
+
+func walkSpawningFrom(done <-chan struct{}, root *BarnesHutNode, visit, post func(*BarnesHutNode), numThreads int, counters []WorkerCounters) {
+	start := time.Now()
+	walkSpawning(done, root, visit, post, newThreadPool(numThreads), 0, counters)
+	counters[0].Busy += time.Since(start)
+}
+
+/*
+** Like walk, but each child subtree gets its own goroutine while a worker is free.
+** The time a worker spends waiting for its children is not counted as busy.
+ */
+func walkSpawning(done <-chan struct{}, node *BarnesHutNode, visit, post func(*BarnesHutNode), pool *threadPool, worker int, counters []WorkerCounters) {
+	if node == nil || cancelled(done) {
+		return
+	}
+	counters[worker].Tasks++
+	if visit != nil {
+		visit(node)
+	}
+
+	var wgChildren sync.WaitGroup
+	spawned := false
+	for _, child := range node.quadrants() {
+		if child == nil {
+			continue
+		}
+		if childWorker, ok := pool.tryAcquire(); ok {
+			spawned = true
+			wgChildren.Add(1)
+			go func(child *BarnesHutNode, childWorker int) {
+				defer wgChildren.Done()
+				defer pool.release(childWorker)
+				start := time.Now()
+				walkSpawning(done, child, visit, post, pool, childWorker, counters)
+				counters[childWorker].Busy += time.Since(start)
+			}(child, childWorker)
+		} else {
+			walkSpawning(done, child, visit, post, pool, worker, counters)
+		}
+	}
+	if spawned {
+		waitStart := time.Now()
+		wgChildren.Wait()
+		counters[worker].Busy -= time.Since(waitStart)
+	}
+
+	if post != nil {
+		post(node)
+	}
+}
+
+// Runs fn for the particles of the subtree in tree order (topLeft, topRight, botLeft, botRight).
+func forEachParticleIn(node *BarnesHutNode, fn func(*Particle)) {
+	if node == nil {
+		return
+	}
+	if node.particle != nil {
+		fn(node.particle)
+	}
+	for _, child := range node.quadrants() {
+		forEachParticleIn(child, fn)
+	}
+}
+
+func collectParticles(root *BarnesHutNode, nParticles int) []*Particle {
+	particles := make([]*Particle, 0, nParticles)
+	forEachParticleIn(root, func(p *Particle) {
+		particles = append(particles, p)
+	})
+	return particles
+}
+
+// Runs fn over particles[bounds[t]:bounds[t+1]] on thread t.
+func runChunks(done <-chan struct{}, particles []*Particle, bounds []int, fn func(*Particle), counters []WorkerCounters) {
+	var wg sync.WaitGroup
+	for t := 0; t+1 < len(bounds); t++ {
+		wg.Add(1)
+		go func(threadNum int, chunk []*Particle) {
+			defer wg.Done()
+			start := time.Now()
+			for _, p := range chunk {
+				if cancelled(done) {
+					break
+				}
+				fn(p)
+				counters[threadNum].Tasks++
+			}
+			counters[threadNum].Busy += time.Since(start)
+		}(t, particles[bounds[t]:bounds[t+1]])
+	}
+	wg.Wait()
+}
+
+/*
+** Static COM: the subtrees at the first level with at least numThreads nodes are dealt
+** round-robin to the threads, then the levels above them are combined sequentially.
+ */
+func calcCenterOfMassStatic(done <-chan struct{}, root *BarnesHutNode, numThreads int, counters []WorkerCounters) {
+	depth := 0
+	for width := 1; width < numThreads; width *= 4 {
+		depth++
+	}
+	subtrees := subtreesAtDepth(root, depth, nil)
+
+	var wg sync.WaitGroup
+	for t := 0; t < numThreads; t++ {
+		wg.Add(1)
+		go func(threadNum int) {
+			defer wg.Done()
+			start := time.Now()
+			for i := threadNum; i < len(subtrees); i += numThreads {
+				walk(done, subtrees[i], nil, setCenterOfMass, &counters[threadNum])
+			}
+			counters[threadNum].Busy += time.Since(start)
+		}(t)
+	}
+	wg.Wait()
+
+	start := time.Now()
+	combineCenterOfMass(root, depth)
+	counters[0].Busy += time.Since(start)
+}
+
+// Appends the nodes at the given depth, and the leaves above it, in tree order.
+func subtreesAtDepth(node *BarnesHutNode, depth int, subtrees []*BarnesHutNode) []*BarnesHutNode {
+	if node == nil {
+		return subtrees
+	}
+	if depth == 0 || node.isLeaf() {
+		return append(subtrees, node)
+	}
+	for _, child := range node.quadrants() {
+		subtrees = subtreesAtDepth(child, depth-1, subtrees)
+	}
+	return subtrees
+}
+
+// Calculates the COM of the nodes above depth, whose subtrees below are already done.
+func combineCenterOfMass(node *BarnesHutNode, depth int) {
+	if node == nil || depth == 0 || node.isLeaf() {
+		return
+	}
+	for _, child := range node.quadrants() {
+		combineCenterOfMass(child, depth-1)
+	}
+	setCenterOfMass(node)
+}
+
+/*
+** Sets the COM and particle count of a node from its particle, or from its children
+** which must already be done. Same summation order as CalcCenterOfMass.
+ */
+func setCenterOfMass(node *BarnesHutNode) {
+	if node.isLeaf() {
+		if node.particle != nil {
+			node.totalMass = node.particle.mass
+			node.nParticles = 1
+			node.comX = node.particle.x
+			node.comY = node.particle.y
+		}
+		return
+	}
+
+	var totalMass float64 = 0.0
+	var comX float64 = 0.0
+	var comY float64 = 0.0
+	var nParticles int32 = 0
+	for _, child := range node.quadrants() {
+		if child != nil && child.totalMass > 0.0 {
+			totalMass += child.totalMass
+			comX += child.comX * child.totalMass
+			comY += child.comY * child.totalMass
+			nParticles += child.nParticles
+		}
+	}
+	node.totalMass = totalMass
+	node.nParticles = nParticles
+	if totalMass > 0.0 {
+		node.comX = comX / totalMass
+		node.comY = comY / totalMass
+	} else {
+		node.comX = 0.0
+		node.comY = 0.0
+	}
+}
@@ -0,0 +1,80 @@
+package barneshut
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Columns of a text snapshot, named by its "# columns" header line.
+var snapshotColumns = []string{"id", "x", "y", "vx", "vy", "ax", "ay", "mass"}
+
+/*
+** The header of a snapshot: when it was taken and how the run was set up.
+ */
+type SnapshotHeader struct {
+	Step   int               // Completed time-steps.
+	Time   float64           // Simulated time, Step * dt.
+	Params map[string]string // Run parameters, written in key order.
+}
+
+/*
+** Writes the full state of the particles as text, sorted by ID: a header of "#" lines
+** followed by one "id x y vx vy ax ay mass" line per particle, each float with the
+** shortest representation that reads back to the same float64. The accelerations are
+** those of the last step. The file can be loaded again as FormatText.
+ */
+func WriteSnapshot(w io.Writer, header SnapshotHeader, particles []*Particle) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "# barnes-hut snapshot")
+	fmt.Fprintf(out, "# step %d\n", header.Step)
+	fmt.Fprintf(out, "# time %s\n", formatFloat(header.Time))
+	fmt.Fprintf(out, "# n %d\n", len(particles))
+	keys := make([]string, 0, len(header.Params))
+	for key := range header.Params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(out, "# param %s=%s\n", key, header.Params[key])
+	}
+	fmt.Fprint(out, "# columns")
+	for _, column := range snapshotColumns {
+		fmt.Fprint(out, " ", column)
+	}
+	fmt.Fprintln(out)
+
+	for _, p := range sortedByID(particles) {
+		fmt.Fprintf(out, "%d %s %s %s %s %s %s %s\n", p.id, formatFloat(p.x), formatFloat(p.y),
+			formatFloat(p.vx), formatFloat(p.vy), formatFloat(p.fx), formatFloat(p.fy), formatFloat(p.mass))
+	}
+	return out.Flush()
+}
+
+/*
+** Writes a snapshot to path, replacing the file.
+ */
+func WriteSnapshotFile(path string, header SnapshotHeader, particles []*Particle) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := WriteSnapshot(file, header, particles); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func sortedByID(particles []*Particle) []*Particle {
+	sorted := append([]*Particle(nil), particles...)
+	sort.SliceStable(sorted, func(a, b int) bool { return sorted[a].id < sorted[b].id })
+	return sorted
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,140 @@
+package barneshut
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// The supersteps of a time-step, in the order RunSimulation runs them.
+type Phase int
+
+const (
+	PhaseCenterOfMass Phase = iota
+	PhaseVelocity
+	PhasePosition
+	NumPhases
+)
+
+var phaseNames = [NumPhases]string{"com", "velocity", "position"}
+
+func (phase Phase) String() string {
+	return phaseNames[phase]
+}
+
+/*
+** What a worker did during one phase, filled in by the Scheduler.
+** Tasks are tree nodes for the traversals and deque tasks, particles for the
+** chunked schedulers. Busy is the time spent working rather than waiting.
+ */
+type WorkerCounters struct {
+	Tasks        int64
+	Steals       int64 // Successful steal attempts.
+	FailedSteals int64 // Probes that found the victim's deque empty.
+	Busy         time.Duration
+}
+
+type WorkerStats struct {
+	Tasks        int64
+	Steals       int64
+	FailedSteals int64
+	Idle         time.Duration            // Phase time not spent busy, over all phases.
+	Phases       [NumPhases]time.Duration // Busy time in each phase.
+}
+
+/*
+** Instrumentation of one or more time-steps, returned by RunSimulation.
+ */
+type Stats struct {
+	Scheduler string
+	Steps     int
+	Phases    [NumPhases]time.Duration // Wall time of each phase.
+	Workers   []WorkerStats
+}
+
+func NewStats(sched Scheduler) Stats {
+	return Stats{Scheduler: sched.Name(), Workers: make([]WorkerStats, sched.NumThreads())}
+}
+
+/*
+** Runs one phase with fresh counters and adds them to the stats.
+ */
+func (stats *Stats) runPhase(phase Phase, run func(counters []WorkerCounters)) {
+	counters := make([]WorkerCounters, len(stats.Workers))
+	start := time.Now()
+	run(counters)
+	wall := time.Since(start)
+
+	stats.Phases[phase] += wall
+	for t := range counters {
+		worker := &stats.Workers[t]
+		worker.Tasks += counters[t].Tasks
+		worker.Steals += counters[t].Steals
+		worker.FailedSteals += counters[t].FailedSteals
+		worker.Phases[phase] += counters[t].Busy
+		if idle := wall - counters[t].Busy; idle > 0 {
+			worker.Idle += idle
+		}
+	}
+}
+
+/*
+** Accumulates the stats of another run with the same scheduler, e.g. the next time-step.
+ */
+func (stats *Stats) Add(other Stats) {
+	if stats.Workers == nil {
+		stats.Scheduler = other.Scheduler
+		stats.Workers = make([]WorkerStats, len(other.Workers))
+	}
+	stats.Steps += other.Steps
+	for phase := range stats.Phases {
+		stats.Phases[phase] += other.Phases[phase]
+	}
+	for t := range stats.Workers {
+		worker, otherWorker := &stats.Workers[t], &other.Workers[t]
+		worker.Tasks += otherWorker.Tasks
+		worker.Steals += otherWorker.Steals
+		worker.FailedSteals += otherWorker.FailedSteals
+		worker.Idle += otherWorker.Idle
+		for phase := range worker.Phases {
+			worker.Phases[phase] += otherWorker.Phases[phase]
+		}
+	}
+}
+
+/*
+** Prints the phase times and a row per worker as an aligned table.
+ */
+func (stats *Stats) Fprint(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "scheduler: %s, threads: %d, steps: %d\n", stats.Scheduler, len(stats.Workers), stats.Steps)
+
+	fmt.Fprint(tw, "phase\t")
+	for phase := Phase(0); phase < NumPhases; phase++ {
+		fmt.Fprintf(tw, "%s\t", phase)
+	}
+	fmt.Fprint(tw, "\nwall\t")
+	for phase := Phase(0); phase < NumPhases; phase++ {
+		fmt.Fprintf(tw, "%s\t", formatSeconds(stats.Phases[phase]))
+	}
+	fmt.Fprint(tw, "\n\n")
+
+	fmt.Fprint(tw, "worker\ttasks\tsteals\tfailed steals\tidle\t")
+	for phase := Phase(0); phase < NumPhases; phase++ {
+		fmt.Fprintf(tw, "%s\t", phase)
+	}
+	fmt.Fprintln(tw)
+	for t, worker := range stats.Workers {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%s\t", t, worker.Tasks, worker.Steals, worker.FailedSteals, formatSeconds(worker.Idle))
+		for phase := Phase(0); phase < NumPhases; phase++ {
+			fmt.Fprintf(tw, "%s\t", formatSeconds(worker.Phases[phase]))
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+func formatSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.4fs", d.Seconds())
+}
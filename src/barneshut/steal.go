@@ -0,0 +1,100 @@
+package barneshut
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Victim selection policies for work stealing.
+const (
+	VictimRoundRobin   = "roundrobin"   // Probe threadNum+1, threadNum+2, ... (the original order).
+	VictimRandom       = "random"       // Probe every other deque once, in a new random order each round.
+	VictimBackoff      = "backoff"      // Random, and sleep exponentially longer after each failed round.
+	VictimHierarchical = "hierarchical" // Probe the nearest thread numbers first: t±1, t±2, ...
+)
+
+const (
+	minStealBackoff = time.Microsecond
+	maxStealBackoff = time.Millisecond
+)
+
+func validVictimPolicy(policy string) error {
+	switch policy {
+	case VictimRoundRobin, VictimRandom, VictimBackoff, VictimHierarchical, "":
+		return nil
+	}
+	return fmt.Errorf("unknown victim policy %q", policy)
+}
+
+/*
+** The stealing state of one worker.
+ */
+type thief struct {
+	threadNum int
+	policy    string
+	batch     bool  // Steal half of the victim's deque instead of one task.
+	victims   []int // Probe order, reshuffled each round by the random policies.
+	rng       *rand.Rand
+	backoff   time.Duration
+}
+
+func newThief(threadNum int, numThreads int, policy string, batch bool) *thief {
+	t := &thief{threadNum: threadNum, policy: policy, batch: batch, backoff: minStealBackoff}
+	for i := 1; i < numThreads; i++ {
+		t.victims = append(t.victims, (threadNum+i)%numThreads)
+	}
+	switch policy {
+	case VictimRandom, VictimBackoff:
+		t.rng = rand.New(rand.NewSource(int64(threadNum) + 1))
+	case VictimHierarchical:
+		// Alternate between the neighbours above and below at growing distance.
+		t.victims = t.victims[:0]
+		for d := 1; len(t.victims) < numThreads-1; d++ {
+			t.victims = append(t.victims, (threadNum+d)%numThreads)
+			if below := (threadNum - d + numThreads) % numThreads; below != (threadNum+d)%numThreads && len(t.victims) < numThreads-1 {
+				t.victims = append(t.victims, below)
+			}
+		}
+	}
+	return t
+}
+
+// WORK STEALING
+func (t *thief) stealTask(deques []*Deque, counters *WorkerCounters) Task {
+	if t.rng != nil {
+		t.rng.Shuffle(len(t.victims), func(i, j int) {
+			t.victims[i], t.victims[j] = t.victims[j], t.victims[i]
+		})
+	}
+
+	for _, victim := range t.victims {
+		if t.batch {
+			stolen := deques[victim].PopBackHalf()
+			if len(stolen) > 0 {
+				counters.Steals++
+				t.backoff = minStealBackoff
+				// Keep the oldest task to run now and queue the rest as the victim held
+				// them, the oldest at the back where the next thief takes it.
+				for k := len(stolen) - 1; k > 0; k-- {
+					deques[t.threadNum].PushBack(stolen[k])
+				}
+				return stolen[0]
+			}
+		} else {
+			stolenTask, foundThisTime := deques[victim].PopBack()
+			if foundThisTime {
+				counters.Steals++
+				t.backoff = minStealBackoff
+				return stolenTask
+			}
+		}
+		counters.FailedSteals++
+	}
+
+	if t.policy == VictimBackoff {
+		time.Sleep(t.backoff)
+		t.backoff = min(2*t.backoff, maxStealBackoff)
+	}
+	return Task{Node: nil}
+}
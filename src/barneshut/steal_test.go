@@ -0,0 +1,68 @@
+package barneshut
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+/*
+** One time-step of 20000 particles with work stealing on every core, for each victim
+** policy with and without batch stealing:
+**
+**	go test -bench=Steal -cpu=1,2,4,8 ./src/barneshut
+ */
+func BenchmarkStealStep(b *testing.B) {
+	for _, victim := range []string{VictimRoundRobin, VictimRandom, VictimBackoff, VictimHierarchical} {
+		for _, batch := range []bool{false, true} {
+			b.Run(fmt.Sprintf("victim=%s/batch=%t", victim, batch), func(b *testing.B) {
+				sched, err := NewScheduler(SchedulerOptions{Name: SchedulerWorkStealing, NumThreads: runtime.GOMAXPROCS(0), Victim: victim, BatchSteal: batch})
+				if err != nil {
+					b.Fatal(err)
+				}
+				particles := testParticles(20000, 1)
+				for i := 0; i < b.N; i++ {
+					// The particles move a little every step, which does not change the cost.
+					b.StopTimer()
+					root := newTree(particles)
+					b.StartTimer()
+					RunSimulation(root, sched, 1, len(particles))
+				}
+			})
+		}
+	}
+}
+
+/*
+** An owner pushes the children it splits off at the front, so its back holds the
+** oldest tasks. A batch steal must leave the thief's deque in the same order: the
+** oldest stolen task at the back for the next thief, the youngest at the front.
+ */
+func TestBatchStealOrder(t *testing.T) {
+	deques := []*Deque{NewDeque(), NewDeque()}
+	for depth := 0; depth < 6; depth++ {
+		deques[0].PushFront(Task{Depth: depth})
+	}
+	thief := newThief(1, 2, VictimRoundRobin, true)
+	if task := thief.stealTask(deques, &WorkerCounters{}); task.Depth != 0 {
+		t.Fatalf("stole depth %d to run, want the oldest, 0", task.Depth)
+	}
+	var back, front []int
+	for {
+		task, ok := deques[1].PopBack()
+		if !ok {
+			break
+		}
+		back = append(back, task.Depth)
+	}
+	for {
+		task, ok := deques[0].PopFront()
+		if !ok {
+			break
+		}
+		front = append(front, task.Depth)
+	}
+	if fmt.Sprint(back) != "[1 2]" || fmt.Sprint(front) != "[5 4 3]" {
+		t.Errorf("thief's deque from the back %v, victim's from the front %v, want [1 2] and [5 4 3]", back, front)
+	}
+}
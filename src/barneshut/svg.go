@@ -0,0 +1,192 @@
+package barneshut
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+/*
+** How WriteSVG draws the particles and the quadtree. The zero value draws 800x800
+** pixels of the particles' bounds with every cell.
+ */
+type SVGOptions struct {
+	Width, Height          int     // Pixels, 800 if 0.
+	MinX, MaxX, MinY, MaxY float64 // Viewport, the bounds of the particles with a margin if empty.
+	PointRadius            float64 // Radius of a particle in pixels, 3 if 0.
+	HideCells              bool    // Leave out the quadtree cells.
+	Labels                 bool    // Write the ID next to every particle.
+	Highlight              bool    // Show the force walk of the particle HighlightID.
+	HighlightID            int64
+}
+
+// How the force walk of a particle used a node.
+const (
+	walkOpened      = iota // s/D too large, the walk went into its quadrants.
+	walkApproximate        // Its center of mass was used for the whole cell.
+	walkDirect             // A leaf, its particle was used.
+)
+
+/*
+** Calls visit for every node the force walk of particle reaches, with how it is used,
+** making the decisions ForceCalculation makes. Empty quadrants are skipped.
+ */
+func walkForce(particle *Particle, node *BarnesHutNode, visit func(node *BarnesHutNode, use int)) {
+	if node == nil || node.particle == particle || node.totalMass == 0 {
+		return
+	}
+	dx, dy := particle.x-node.comX, particle.y-node.comY
+	D := math.Sqrt(dx*dx + dy*dy + SOFTENING)
+	S := node.rightX - node.leftX
+	switch {
+	case node.particle != nil:
+		visit(node, walkDirect)
+	case S/D < THETA:
+		visit(node, walkApproximate)
+	default:
+		visit(node, walkOpened)
+		for _, child := range node.quadrants() {
+			walkForce(particle, child, visit)
+		}
+	}
+}
+
+/*
+** Draws the particles over the cells of their quadtree as SVG, y up. The root spans the
+** whole float range, so the cells are clipped to the viewport and those outside it
+** are left out.
+**
+** With Highlight, the force walk of the particle HighlightID on the tree is shown as
+** ForceCalculation makes it: the cells it opened are outlined in blue, the cells whose
+** center of mass it used instead of their particles are filled in orange with the
+** center of mass marked and joined to the particle, and the leaves whose particle it
+** used directly are filled in green. The particle itself is red.
+ */
+func WriteSVG(w io.Writer, particles []*Particle, opts SVGOptions) error {
+	view := RenderOptions{Width: opts.Width, Height: opts.Height, MinX: opts.MinX, MaxX: opts.MaxX, MinY: opts.MinY, MaxY: opts.MaxY}
+	view = view.FitViewport(particles)
+	width, height := float64(view.Width), float64(view.Height)
+	radius := opts.PointRadius
+	if radius <= 0 {
+		radius = 3
+	}
+	// Pixel coordinates, clamped a little outside the frame so huge cells stay finite.
+	px := func(x float64) float64 {
+		return min(max((x-view.MinX)/(view.MaxX-view.MinX)*width, -10), width+10)
+	}
+	py := func(y float64) float64 {
+		return min(max((view.MaxY-y)/(view.MaxY-view.MinY)*height, -10), height+10)
+	}
+	visible := func(node *BarnesHutNode) bool {
+		return node.rightX > view.MinX && node.leftX < view.MaxX && node.topY > view.MinY && node.botY < view.MaxY
+	}
+	// The cells far larger than the viewport all clip to the frame, so a rectangle is
+	// drawn once per style.
+	drawn := make(map[string]bool)
+	rect := func(out *bufio.Writer, node *BarnesHutNode, style string) {
+		x, y := px(node.leftX), py(node.topY)
+		element := fmt.Sprintf("<rect x=\"%s\" y=\"%s\" width=\"%s\" height=\"%s\"%s/>", svgNumber(x), svgNumber(y),
+			svgNumber(px(node.rightX)-x), svgNumber(py(node.botY)-y), style)
+		if !drawn[element] {
+			drawn[element] = true
+			fmt.Fprintln(out, element)
+		}
+	}
+
+	root := newTree(particles)
+	CalcCenterOfMass(root)
+	var highlighted *Particle
+	if opts.Highlight {
+		for _, p := range particles {
+			if p.id == opts.HighlightID {
+				highlighted = p
+			}
+		}
+		if highlighted == nil {
+			return fmt.Errorf("no particle with id %d", opts.HighlightID)
+		}
+	}
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n",
+		view.Width, view.Height, view.Width, view.Height)
+	fmt.Fprintf(out, "<rect width=\"%d\" height=\"%d\" fill=\"white\"/>\n", view.Width, view.Height)
+
+	if highlighted != nil {
+		fmt.Fprintln(out, `<g id="walk">`)
+		var lines []string
+		walkForce(highlighted, root, func(node *BarnesHutNode, use int) {
+			if !visible(node) {
+				return
+			}
+			switch use {
+			case walkOpened:
+				rect(out, node, ` fill="none" stroke="#1f77b4" stroke-width="2"`)
+			case walkApproximate:
+				rect(out, node, ` fill="#ff7f0e" fill-opacity="0.3" stroke="none"`)
+				lines = append(lines, fmt.Sprintf("<line x1=\"%s\" y1=\"%s\" x2=\"%s\" y2=\"%s\" stroke=\"#ff7f0e\" stroke-width=\"1\"/>\n"+
+					"<circle cx=\"%s\" cy=\"%s\" r=\"%s\" fill=\"none\" stroke=\"#ff7f0e\" stroke-width=\"2\"/>",
+					svgNumber(px(highlighted.x)), svgNumber(py(highlighted.y)), svgNumber(px(node.comX)), svgNumber(py(node.comY)),
+					svgNumber(px(node.comX)), svgNumber(py(node.comY)), svgNumber(radius+1)))
+			case walkDirect:
+				rect(out, node, ` fill="#2ca02c" fill-opacity="0.3" stroke="none"`)
+			}
+		})
+		for _, line := range lines {
+			fmt.Fprintln(out, line)
+		}
+		fmt.Fprintln(out, `</g>`)
+	}
+
+	if !opts.HideCells {
+		fmt.Fprintln(out, `<g id="cells" fill="none" stroke="black" stroke-width="0.5">`)
+		var drawCells func(node *BarnesHutNode)
+		drawCells = func(node *BarnesHutNode) {
+			if node == nil || node.totalMass == 0 || !visible(node) {
+				return
+			}
+			rect(out, node, "")
+			for _, child := range node.quadrants() {
+				drawCells(child)
+			}
+		}
+		drawCells(root)
+		fmt.Fprintln(out, `</g>`)
+	}
+
+	fmt.Fprintln(out, `<g id="particles">`)
+	for _, p := range sortedByID(particles) {
+		if p.x < view.MinX || p.x > view.MaxX || p.y < view.MinY || p.y > view.MaxY {
+			continue
+		}
+		fill := "black"
+		if p == highlighted {
+			fill = "#d62728"
+		}
+		fmt.Fprintf(out, "<circle cx=\"%s\" cy=\"%s\" r=\"%s\" fill=\"%s\"/>\n", svgNumber(px(p.x)), svgNumber(py(p.y)), svgNumber(radius), fill)
+		if opts.Labels {
+			fmt.Fprintf(out, "<text x=\"%s\" y=\"%s\" font-family=\"sans-serif\" font-size=\"%s\">%d</text>\n",
+				svgNumber(px(p.x)+radius+1), svgNumber(py(p.y)+4*radius), svgNumber(4*radius), p.id)
+		}
+	}
+	fmt.Fprintln(out, `</g>`)
+	fmt.Fprintln(out, `</svg>`)
+	return out.Flush()
+}
+
+// A pixel coordinate with two decimals, enough for any screen or print.
+func svgNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+/*
+** Writes the SVG of the particles to path, replacing the file atomically, so a failed
+** write, e.g. of a missing highlight, leaves the old file in place.
+ */
+func WriteSVGFile(path string, particles []*Particle, opts SVGOptions) error {
+	return WriteFileAtomic(path, func(w io.Writer) error {
+		return WriteSVG(w, particles, opts)
+	})
+}
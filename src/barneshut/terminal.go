@@ -0,0 +1,254 @@
+package barneshut
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// How RenderTerminal draws the particles.
+const (
+	TerminalBraille = "braille" // 2x4 dots per character, lit in proportion to the log density.
+	TerminalBlocks  = "blocks"  // One shade per character by the log density, from ░ to █.
+)
+
+/*
+** How RenderTerminal draws a map. The zero value draws 80x24 braille characters of the
+** particles' bounds.
+ */
+type TerminalOptions struct {
+	Columns, Rows          int     // Characters, 80x24 if 0.
+	MinX, MaxX, MinY, MaxY float64 // Viewport, the bounds of the particles with a margin if empty.
+	Mode                   string  // TerminalBraille if empty, or TerminalBlocks.
+}
+
+/*
+** The dots of a character: 2 across and 4 down for braille, 1 across and 2 down for
+** blocks, so that with characters twice as tall as wide the dots are square.
+ */
+func (opts TerminalOptions) dots() (int, int) {
+	if opts.Mode == TerminalBlocks {
+		return 1, 2
+	}
+	return 2, 4
+}
+
+/*
+** The options with the default size and mode, and with the viewport fitted to the
+** particles if it is empty. A sequence of maps fits the viewport once.
+ */
+func (opts TerminalOptions) FitViewport(particles []*Particle) TerminalOptions {
+	if opts.Columns <= 0 {
+		opts.Columns = 80
+	}
+	if opts.Rows <= 0 {
+		opts.Rows = 24
+	}
+	if opts.Mode == "" {
+		opts.Mode = TerminalBraille
+	}
+	dx, dy := opts.dots()
+	view := RenderOptions{Width: opts.Columns * dx, Height: opts.Rows * dy, MinX: opts.MinX, MaxX: opts.MaxX, MinY: opts.MinY, MaxY: opts.MaxY}
+	view = view.FitViewport(particles)
+	opts.MinX, opts.MaxX, opts.MinY, opts.MaxY = view.MinX, view.MaxX, view.MinY, view.MaxY
+	return opts
+}
+
+// The bit of the braille dot at (x, y) of a character, U+2800 plus the bits of its dots.
+var brailleBits = [4][2]rune{{0x01, 0x08}, {0x02, 0x10}, {0x04, 0x20}, {0x40, 0x80}}
+
+// The order in which the dots of a braille character are lit, spread over the cell.
+var brailleOrder = [4][2]int{{0, 4}, {6, 2}, {1, 5}, {7, 3}}
+
+var blockShades = []rune{' ', '░', '▒', '▓', '█'}
+
+/*
+** Draws a density map of the particles, y up, as lines of characters. A character
+** covering c particles, out of at most m on one character, is filled in proportion to
+** log(1+c)/log(1+m) and never left empty: in braille with as many of its 8 dots,
+** rounded down, those holding particles first, and in blocks with one of 4 shades.
+ */
+func RenderTerminal(particles []*Particle, opts TerminalOptions) []string {
+	opts = opts.FitViewport(particles)
+	dx, dy := opts.dots()
+	width, height := opts.Columns*dx, opts.Rows*dy
+	counts := make([]int, width*height)
+	for _, p := range particles {
+		px := (p.x - opts.MinX) / (opts.MaxX - opts.MinX) * float64(width)
+		py := (opts.MaxY - p.y) / (opts.MaxY - opts.MinY) * float64(height)
+		if !(px >= 0 && px < float64(width) && py >= 0 && py < float64(height)) {
+			continue
+		}
+		counts[int(py)*width+int(px)]++
+	}
+
+	// The particles on every character.
+	cells := make([]int, opts.Columns*opts.Rows)
+	maxCell := 0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			cell := (y/dy)*opts.Columns + x/dx
+			cells[cell] += counts[y*width+x]
+			maxCell = max(maxCell, cells[cell])
+		}
+	}
+	fill := func(c int) float64 {
+		if c == 0 {
+			return 0
+		}
+		return math.Log1p(float64(c)) / math.Log1p(float64(maxCell))
+	}
+
+	lines := make([]string, opts.Rows)
+	var line strings.Builder
+	for row := 0; row < opts.Rows; row++ {
+		line.Reset()
+		for col := 0; col < opts.Columns; col++ {
+			c := cells[row*opts.Columns+col]
+			if c == 0 {
+				if opts.Mode == TerminalBlocks {
+					line.WriteRune(' ')
+				} else {
+					line.WriteRune(0x2800)
+				}
+				continue
+			}
+			if opts.Mode == TerminalBlocks {
+				shade := max(int(math.Ceil(fill(c)*float64(len(blockShades)-1))), 1)
+				line.WriteRune(blockShades[shade])
+				continue
+			}
+			// Light the dots holding the most particles, then the rest in a spread order.
+			type dot struct{ count, order, x, y int }
+			var cellDots [8]dot
+			for y := 0; y < 4; y++ {
+				for x := 0; x < 2; x++ {
+					cellDots[y*2+x] = dot{counts[(row*4+y)*width+col*2+x], brailleOrder[y][x], x, y}
+				}
+			}
+			sort.Slice(cellDots[:], func(i, j int) bool {
+				if cellDots[i].count != cellDots[j].count {
+					return cellDots[i].count > cellDots[j].count
+				}
+				return cellDots[i].order < cellDots[j].order
+			})
+			lit := max(int(fill(c)*8), 1)
+			r := rune(0x2800)
+			for _, d := range cellDots[:lit] {
+				r |= brailleBits[d.y][d.x]
+			}
+			line.WriteRune(r)
+		}
+		lines[row] = line.String()
+	}
+	return lines
+}
+
+/*
+** Redraws a density map and status lines in place on a terminal with ANSI escapes:
+** the step and time, and the kinetic, potential and total energy with its drift since
+** the first map, in percent unless the first total was 0.
+ */
+type TerminalDisplay struct {
+	w       io.Writer
+	opts    TerminalOptions
+	started bool
+	energy0 float64 // Total energy of the first map.
+}
+
+/*
+** A display of the map on the rows of the terminal left after the status lines. The
+** viewport is fitted to the particles of the first map if it is empty.
+ */
+func NewTerminalDisplay(w io.Writer, opts TerminalOptions) *TerminalDisplay {
+	if opts.Rows <= 0 {
+		opts.Rows = 24
+	}
+	opts.Rows = max(opts.Rows-terminalStatusLines, 1)
+	return &TerminalDisplay{w: w, opts: opts}
+}
+
+// Lines below the map, and the one the cursor is left on.
+const terminalStatusLines = 3
+
+func (display *TerminalDisplay) Draw(step, steps int, time float64, particles []*Particle) error {
+	out := bufio.NewWriter(display.w)
+	kinetic, potential := Energy(particles)
+	total := kinetic + potential
+	if !display.started {
+		display.opts = display.opts.FitViewport(particles)
+		display.energy0 = total
+		display.started = true
+		fmt.Fprint(out, "\x1b[?25l\x1b[2J") // Hide the cursor and clear the screen.
+	}
+
+	fmt.Fprint(out, "\x1b[H")
+	for _, line := range RenderTerminal(particles, display.opts) {
+		fmt.Fprintln(out, line)
+	}
+	short := func(v float64) string { return strconv.FormatFloat(v, 'g', 6, 64) }
+	status := fmt.Sprintf("step %d/%d  time %s  %d particles  x [%s, %s]  y [%s, %s]", step, steps, short(time), len(particles),
+		short(display.opts.MinX), short(display.opts.MaxX), short(display.opts.MinY), short(display.opts.MaxY))
+	// The drift is relative unless the first total was 0, e.g. a single particle at rest.
+	drift := fmt.Sprintf("%+.3g%%", 100*(total-display.energy0)/math.Abs(display.energy0))
+	if display.energy0 == 0 {
+		drift = fmt.Sprintf("%+.3g", total)
+	}
+	energy := fmt.Sprintf("energy %s  drift %s  kinetic %s  potential %s", short(total), drift, short(kinetic), short(potential))
+	for _, line := range []string{status, energy} {
+		fmt.Fprintf(out, "%s\x1b[K\n", truncateRunes(line, display.opts.Columns))
+	}
+	return out.Flush()
+}
+
+// The first n characters of s.
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	return string(runes[:min(len(runes), n)])
+}
+
+/*
+** Shows the cursor again, below the last map.
+ */
+func (display *TerminalDisplay) Close() error {
+	_, err := fmt.Fprint(display.w, "\x1b[?25h")
+	return err
+}
+
+/*
+** The kinetic and potential energy of the particles, the potential from a walk of
+** their tree with the opening criterion of ForceCalculation, so it costs as much as
+** a force calculation. With G = 1 and the same softening, the total is conserved up
+** to the errors of the time-steps and of the approximation.
+ */
+func Energy(particles []*Particle) (kinetic, potential float64) {
+	root := newTree(particles)
+	CalcCenterOfMass(root)
+	for _, p := range particles {
+		kinetic += 0.5 * p.mass * (p.vx*p.vx + p.vy*p.vy)
+		// Every pair is counted from both sides.
+		potential += 0.5 * p.mass * potentialAt(p, root)
+	}
+	return kinetic, potential
+}
+
+// The potential at the particle of the nodes below node, other than itself.
+func potentialAt(particle *Particle, node *BarnesHutNode) float64 {
+	if node == nil || node.particle == particle || node.totalMass == 0 {
+		return 0
+	}
+	dx, dy := particle.x-node.comX, particle.y-node.comY
+	D := math.Sqrt(dx*dx + dy*dy + SOFTENING)
+	if node.particle != nil || (node.rightX-node.leftX)/D < THETA {
+		return -node.totalMass / D
+	}
+	potential := 0.0
+	for _, child := range node.quadrants() {
+		potential += potentialAt(particle, child)
+	}
+	return potential
+}
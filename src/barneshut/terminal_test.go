@@ -0,0 +1,22 @@
+package barneshut
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTerminalDisplayZeroEnergy(t *testing.T) {
+	// A particle at rest has no energy to measure the drift against.
+	particles := []*Particle{NewParticle(1, 2)}
+	var out bytes.Buffer
+	display := NewTerminalDisplay(&out, TerminalOptions{Columns: 80, Rows: 10})
+	for step := 0; step < 2; step++ {
+		if err := display.Draw(step, 1, float64(step), particles); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if strings.Contains(out.String(), "NaN") || !strings.Contains(out.String(), "drift +0 ") {
+		t.Errorf("status of a particle at rest: %q", out.String()[strings.LastIndex(out.String(), "energy"):])
+	}
+}
@@ -0,0 +1,302 @@
+package barneshut
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+)
+
+/*
+** Trajectory files, append-only and little-endian:
+**
+**	header   "BHTRAJ", version uint16, flags uint32 (trajectoryVelocities)
+**	frames   "FRAM", length uint32, payload, CRC-32 (IEEE) of the payload uint32
+**	payload  step int64, time float64, n int64, id int64[n], x float64[n], y float64[n],
+**	         and vx float64[n], vy float64[n] with trajectoryVelocities
+**
+** A frame is written with a single write and only counts once its CRC matches, so a
+** reader of a file being written sees every complete frame and never a partial one.
+ */
+const TrajectoryVersion = 1
+
+const (
+	trajectoryMagic       = "BHTRAJ"
+	trajectoryFrameMagic  = "FRAM"
+	trajectoryHeaderSize  = 12
+	trajectoryVelocities  = 1 << 0
+	trajectoryFrameHeader = 8
+)
+
+// Options of a TrajectoryWriter.
+type TrajectoryOptions struct {
+	Every      int  // Steps between frames, 1 if 0.
+	Stride     int  // Only write the particles whose ID is a multiple of Stride, all if 0 or 1.
+	Velocities bool // Also write the velocities.
+}
+
+/*
+** Appends frames to a trajectory file.
+ */
+type TrajectoryWriter struct {
+	file *os.File
+	opts TrajectoryOptions
+	buf  []byte
+}
+
+/*
+** Creates a trajectory file, replacing any file at path.
+ */
+func CreateTrajectory(path string, opts TrajectoryOptions) (*TrajectoryWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	var flags uint32 = 0
+	if opts.Velocities {
+		flags |= trajectoryVelocities
+	}
+	header := []byte(trajectoryMagic)
+	header = binary.LittleEndian.AppendUint16(header, TrajectoryVersion)
+	header = binary.LittleEndian.AppendUint32(header, flags)
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &TrajectoryWriter{file: file, opts: opts}, nil
+}
+
+/*
+** Reopens a trajectory to continue a restarted run: the frames after step, and any
+** incomplete frame at the end, are dropped. The velocities option of the file is kept.
+ */
+func ResumeTrajectory(path string, opts TrajectoryOptions, step int) (*TrajectoryWriter, error) {
+	reader, err := OpenTrajectory(path)
+	if err != nil {
+		return nil, err
+	}
+	end := reader.end
+	for i := 0; i < reader.NumFrames(); i++ {
+		frame, err := reader.Frame(i)
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+		if frame.Step > step {
+			end = reader.offsets[i]
+			break
+		}
+	}
+	opts.Velocities = reader.velocities
+	reader.Close()
+
+	if err := os.Truncate(path, end); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &TrajectoryWriter{file: file, opts: opts}, nil
+}
+
+/*
+** Whether a frame is due after the step.
+ */
+func (w *TrajectoryWriter) Due(step int) bool {
+	return step%max(1, w.opts.Every) == 0
+}
+
+/*
+** Appends a frame of the particles, sorted by ID and subsampled by the stride.
+ */
+func (w *TrajectoryWriter) WriteFrame(step int, time float64, particles []*Particle) error {
+	var kept []*Particle
+	for _, p := range sortedByID(particles) {
+		if w.opts.Stride <= 1 || p.id%int64(w.opts.Stride) == 0 {
+			kept = append(kept, p)
+		}
+	}
+
+	buf := append(w.buf[:0], trajectoryFrameMagic...)
+	buf = binary.LittleEndian.AppendUint32(buf, 0) // Length, filled in below.
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(step))
+	buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(time))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(kept)))
+	for _, p := range kept {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(p.id))
+	}
+	columns := []func(p *Particle) float64{
+		func(p *Particle) float64 { return p.x }, func(p *Particle) float64 { return p.y },
+	}
+	if w.opts.Velocities {
+		columns = append(columns, func(p *Particle) float64 { return p.vx }, func(p *Particle) float64 { return p.vy })
+	}
+	for _, column := range columns {
+		for _, p := range kept {
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(column(p)))
+		}
+	}
+	payload := buf[trajectoryFrameHeader:]
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(payload)))
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(payload))
+	w.buf = buf
+
+	_, err := w.file.Write(buf)
+	return err
+}
+
+func (w *TrajectoryWriter) Close() error {
+	return w.file.Close()
+}
+
+/*
+** One frame of a trajectory, in columns sorted by ID. VX and VY are nil unless the
+** file has velocities.
+ */
+type TrajectoryFrame struct {
+	Step         int
+	Time         float64
+	ID           []int64
+	X, Y, VX, VY []float64
+}
+
+/*
+** Random access to the frames of a trajectory file, which may still be written.
+ */
+type TrajectoryReader struct {
+	file       *os.File
+	velocities bool
+	offsets    []int64 // Offset of each complete frame.
+	end        int64   // End of the last complete frame.
+}
+
+/*
+** Opens a trajectory and indexes its complete frames.
+ */
+func OpenTrajectory(path string) (*TrajectoryReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, trajectoryHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil || string(header[:6]) != trajectoryMagic {
+		file.Close()
+		return nil, fmt.Errorf("%s: not a trajectory file", path)
+	}
+	if version := binary.LittleEndian.Uint16(header[6:]); version == 0 || version > TrajectoryVersion {
+		file.Close()
+		return nil, fmt.Errorf("%s: unsupported trajectory version %d", path, version)
+	}
+	reader := &TrajectoryReader{
+		file:       file,
+		velocities: binary.LittleEndian.Uint32(header[8:])&trajectoryVelocities != 0,
+		end:        trajectoryHeaderSize,
+	}
+	if err := reader.Refresh(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+/*
+** Indexes the frames completed since the last call. A frame is only read once the file
+** is long enough to hold the length in its header, so a corrupt length is not allocated.
+ */
+func (r *TrajectoryReader) Refresh() error {
+	info, err := r.file.Stat()
+	if err != nil {
+		return err
+	}
+	var header [trajectoryFrameHeader]byte
+	for {
+		if _, err := r.file.ReadAt(header[:], r.end); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if string(header[:4]) != trajectoryFrameMagic {
+			return fmt.Errorf("corrupt trajectory frame at offset %d", r.end)
+		}
+		length := int64(binary.LittleEndian.Uint32(header[4:]))
+		if r.end+trajectoryFrameHeader+length+4 > info.Size() {
+			return nil // Still being written.
+		}
+		record := make([]byte, length+4)
+		if _, err := r.file.ReadAt(record, r.end+trajectoryFrameHeader); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil // Still being written.
+			}
+			return err
+		}
+		if crc32.ChecksumIEEE(record[:length]) != binary.LittleEndian.Uint32(record[length:]) {
+			return nil // Still being written, or cut short by a crash.
+		}
+		r.offsets = append(r.offsets, r.end)
+		r.end += trajectoryFrameHeader + length + 4
+	}
+}
+
+func (r *TrajectoryReader) NumFrames() int {
+	return len(r.offsets)
+}
+
+func (r *TrajectoryReader) HasVelocities() bool {
+	return r.velocities
+}
+
+/*
+** Reads frame i, counting from 0.
+ */
+func (r *TrajectoryReader) Frame(i int) (*TrajectoryFrame, error) {
+	if i < 0 || i >= len(r.offsets) {
+		return nil, fmt.Errorf("frame %d out of range, %d frames", i, len(r.offsets))
+	}
+	var header [trajectoryFrameHeader]byte
+	if _, err := r.file.ReadAt(header[:], r.offsets[i]); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(header[4:]))
+	if _, err := r.file.ReadAt(payload, r.offsets[i]+trajectoryFrameHeader); err != nil {
+		return nil, err
+	}
+	if len(payload) < 24 {
+		return nil, fmt.Errorf("frame %d has %d bytes", i, len(payload))
+	}
+
+	frame := &TrajectoryFrame{
+		Step: int(binary.LittleEndian.Uint64(payload)),
+		Time: math.Float64frombits(binary.LittleEndian.Uint64(payload[8:])),
+	}
+	n := int(binary.LittleEndian.Uint64(payload[16:]))
+	columns := []*[]float64{&frame.X, &frame.Y}
+	if r.velocities {
+		columns = append(columns, &frame.VX, &frame.VY)
+	}
+	// n is checked against the payload before 8*n*(1+len(columns)) can overflow.
+	if n < 0 || n > (len(payload)-24)/(8*(1+len(columns))) || len(payload) != 24+8*n*(1+len(columns)) {
+		return nil, fmt.Errorf("frame %d has %d bytes for %d particles", i, len(payload), n)
+	}
+	data := payload[24:]
+	frame.ID = make([]int64, n)
+	for k := range frame.ID {
+		frame.ID[k] = int64(binary.LittleEndian.Uint64(data[8*k:]))
+	}
+	for c, column := range columns {
+		values := data[8*n*(c+1):]
+		*column = make([]float64, n)
+		for k := range *column {
+			(*column)[k] = math.Float64frombits(binary.LittleEndian.Uint64(values[8*k:]))
+		}
+	}
+	return frame, nil
+}
+
+func (r *TrajectoryReader) Close() error {
+	return r.file.Close()
+}
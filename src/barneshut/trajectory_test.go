@@ -0,0 +1,80 @@
+package barneshut
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTrajectoryRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.bht")
+	writer, err := CreateTrajectory(path, TrajectoryOptions{Velocities: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	particles := testParticles(20, 4)
+	for step := 0; step < 3; step++ {
+		if err := writer.WriteFrame(step, float64(step)/2, particles); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Close()
+
+	reader, err := OpenTrajectory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if reader.NumFrames() != 3 {
+		t.Fatalf("read %d frames, want 3", reader.NumFrames())
+	}
+	frame, err := reader.Frame(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Step != 2 || frame.Time != 1 || len(frame.ID) != 20 || frame.X[5] != particles[5].x || frame.VY[5] != particles[5].vy {
+		t.Errorf("frame 2 read back as step %d, time %v, %d particles", frame.Step, frame.Time, len(frame.ID))
+	}
+}
+
+/*
+** A frame with a valid CRC whose particle count makes 8*n*(1+columns) overflow, so
+** that the product matches the payload length.
+ */
+func TestTrajectoryFrameCountOverflow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.bht")
+	writer, err := CreateTrajectory(path, TrajectoryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteFrame(0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := data[trajectoryHeaderSize+trajectoryFrameHeader : len(data)-4]
+	binary.LittleEndian.PutUint64(payload[16:], 1<<61)
+	binary.LittleEndian.PutUint32(data[len(data)-4:], crc32.ChecksumIEEE(payload))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := OpenTrajectory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if reader.NumFrames() != 1 {
+		t.Fatalf("read %d frames, want 1", reader.NumFrames())
+	}
+	if _, err := reader.Frame(0); err == nil || !strings.Contains(err.Error(), "particles") {
+		t.Errorf("got error %v, want a particle count error", err)
+	}
+}
@@ -0,0 +1,213 @@
+package barneshut
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Names of the quadrants in tree order, as the dumps label the child links.
+var quadrantNames = [4]string{"topLeft", "topRight", "botLeft", "botRight"}
+
+/*
+** A node of a tree dump. Nodes are numbered in preorder from 0 for the root, and
+** children holds the numbers of the existing quadrants in tree order, -1 for nil.
+** A node at the depth limit that has quadrants is truncated, and its subtree is only
+** summarised by its mass, center of mass and number of particles.
+ */
+type treeDumpNode struct {
+	index, depth int
+	node         *BarnesHutNode
+	particles    int // In the subtree, counted rather than taken from nParticles.
+	children     [4]int
+	truncated    bool
+}
+
+/*
+** Flattens the tree below node into dump in preorder, down to maxDepth if it is
+** positive. Returns the number of particles below node.
+ */
+func collectTreeDump(node *BarnesHutNode, depth, maxDepth int, dump *[]treeDumpNode) int {
+	index := len(*dump)
+	*dump = append(*dump, treeDumpNode{index: index, depth: depth, node: node, children: [4]int{-1, -1, -1, -1}})
+	count := 0
+	if node.particle != nil {
+		count = 1
+	}
+	if maxDepth > 0 && depth >= maxDepth && !node.isLeaf() {
+		(*dump)[index].truncated = true
+		count = countParticles(node)
+	} else {
+		for q, child := range node.quadrants() {
+			if child != nil {
+				(*dump)[index].children[q] = len(*dump)
+				count += collectTreeDump(child, depth+1, maxDepth, dump)
+			}
+		}
+	}
+	(*dump)[index].particles = count
+	return count
+}
+
+func countParticles(node *BarnesHutNode) int {
+	if node == nil {
+		return 0
+	}
+	count := 0
+	if node.particle != nil {
+		count = 1
+	}
+	for _, child := range node.quadrants() {
+		count += countParticles(child)
+	}
+	return count
+}
+
+// A float as JSON, null if it is not finite.
+func jsonFloat(v float64) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return "null"
+	}
+	return formatFloat(v)
+}
+
+/*
+** Writes the tree below root as JSON, for maxDepth levels below it if positive:
+**
+**	{"particles": 12, "maxDepth": 0, "nodes": [
+**	{"index": 0, "depth": 0, "leftX": ..., "rightX": ..., "botY": ..., "topY": ...,
+**	 "mass": 12, "comX": ..., "comY": ..., "particles": 12,
+**	 "children": {"topLeft": 1, "topRight": 6, "botLeft": 7, "botRight": 8}},
+**	...
+**	]}
+**
+** one node per line in preorder. A leaf has "id", the ID of its particle, unless it is
+** an empty quadrant, and a node cut off by the depth limit has "truncated": true. The
+** masses and centers of mass are those CalcCenterOfMass left in the nodes.
+ */
+func WriteTreeJSON(w io.Writer, root *BarnesHutNode, maxDepth int) error {
+	var dump []treeDumpNode
+	if root != nil {
+		collectTreeDump(root, 0, maxDepth, &dump)
+	}
+	out := bufio.NewWriter(w)
+	total := 0
+	if len(dump) > 0 {
+		total = dump[0].particles
+	}
+	fmt.Fprintf(out, "{\"particles\": %d, \"maxDepth\": %d, \"nodes\": [\n", total, max(maxDepth, 0))
+	for i, entry := range dump {
+		node := entry.node
+		fmt.Fprintf(out, "{\"index\": %d, \"depth\": %d, \"leftX\": %s, \"rightX\": %s, \"botY\": %s, \"topY\": %s, ",
+			entry.index, entry.depth, jsonFloat(node.leftX), jsonFloat(node.rightX), jsonFloat(node.botY), jsonFloat(node.topY))
+		fmt.Fprintf(out, "\"mass\": %s, \"comX\": %s, \"comY\": %s, \"particles\": %d",
+			jsonFloat(node.totalMass), jsonFloat(node.comX), jsonFloat(node.comY), entry.particles)
+		if node.particle != nil {
+			fmt.Fprintf(out, ", \"id\": %d", node.particle.id)
+		}
+		var links []string
+		for q, child := range entry.children {
+			if child >= 0 {
+				links = append(links, fmt.Sprintf("%q: %d", quadrantNames[q], child))
+			}
+		}
+		if len(links) > 0 {
+			fmt.Fprintf(out, ", \"children\": {%s}", strings.Join(links, ", "))
+		}
+		if entry.truncated {
+			fmt.Fprint(out, ", \"truncated\": true")
+		}
+		fmt.Fprint(out, "}")
+		if i < len(dump)-1 {
+			fmt.Fprint(out, ",")
+		}
+		fmt.Fprintln(out)
+	}
+	fmt.Fprintln(out, "]}")
+	return out.Flush()
+}
+
+/*
+** Writes the tree below root as a Graphviz digraph, for maxDepth levels below it if
+** positive, to be drawn with e.g. dot -Tsvg tree.dot. Internal nodes are boxes with
+** their depth, bounds, mass and center of mass, leaves are ellipses with the ID and
+** position of their particle, empty quadrants are points, and nodes cut off by the
+** depth limit are dashed. The edges are labelled with the quadrant.
+ */
+func WriteTreeDOT(w io.Writer, root *BarnesHutNode, maxDepth int) error {
+	var dump []treeDumpNode
+	if root != nil {
+		collectTreeDump(root, 0, maxDepth, &dump)
+	}
+	short := func(v float64) string { return strconv.FormatFloat(v, 'g', 6, 64) }
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "digraph quadtree {")
+	fmt.Fprintln(out, "  node [fontname=\"monospace\", fontsize=10];")
+	fmt.Fprintln(out, "  edge [fontname=\"monospace\", fontsize=8];")
+	for _, entry := range dump {
+		node := entry.node
+		var shape, label string
+		switch {
+		case node.particle != nil:
+			shape = "ellipse"
+			label = fmt.Sprintf("id %d\\n(%s, %s)\\nmass %s", node.particle.id, short(node.particle.x), short(node.particle.y), short(node.particle.mass))
+		case node.isLeaf():
+			fmt.Fprintf(out, "  n%d [shape=point];\n", entry.index)
+			continue
+		default:
+			shape = "box"
+			label = fmt.Sprintf("depth %d, %d particles\\nx [%s, %s]\\ny [%s, %s]\\nmass %s\\ncom (%s, %s)",
+				entry.depth, entry.particles, short(node.leftX), short(node.rightX), short(node.botY), short(node.topY),
+				short(node.totalMass), short(node.comX), short(node.comY))
+		}
+		style := ""
+		if entry.truncated {
+			style = ", style=dashed"
+			label += "\\n(truncated)"
+		}
+		fmt.Fprintf(out, "  n%d [shape=%s, label=\"%s\"%s];\n", entry.index, shape, label, style)
+	}
+	for _, entry := range dump {
+		for q, child := range entry.children {
+			if child >= 0 {
+				fmt.Fprintf(out, "  n%d -> n%d [label=\"%s\"];\n", entry.index, child, quadrantNames[q])
+			}
+		}
+	}
+	fmt.Fprintln(out, "}")
+	return out.Flush()
+}
+
+/*
+** The writer of a tree dump to path: JSON for .json, DOT for .dot or .gv, an error
+** otherwise, so the path can be checked before the run.
+ */
+func TreeDumpWriter(path string) (func(w io.Writer, root *BarnesHutNode, maxDepth int) error, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return WriteTreeJSON, nil
+	case ".dot", ".gv":
+		return WriteTreeDOT, nil
+	}
+	return nil, fmt.Errorf("%s: tree dumps are .json, .dot or .gv", path)
+}
+
+/*
+** Builds the tree of the particles with its centers of mass and writes it to path as
+** JSON, or as DOT if path ends in .dot or .gv, replacing the file atomically.
+ */
+func WriteTreeFile(path string, particles []*Particle, maxDepth int) error {
+	write, err := TreeDumpWriter(path)
+	if err != nil {
+		return err
+	}
+	root := newTree(particles)
+	CalcCenterOfMass(root)
+	return WriteFileAtomic(path, func(w io.Writer) error {
+		return write(w, root, maxDepth)
+	})
+}
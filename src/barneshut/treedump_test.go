@@ -0,0 +1,113 @@
+package barneshut
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type treeJSON struct {
+	Particles int `json:"particles"`
+	MaxDepth  int `json:"maxDepth"`
+	Nodes     []struct {
+		Index     int            `json:"index"`
+		Depth     int            `json:"depth"`
+		Mass      *float64       `json:"mass"`
+		Particles int            `json:"particles"`
+		ID        *int64         `json:"id"`
+		Children  map[string]int `json:"children"`
+		Truncated bool           `json:"truncated"`
+	} `json:"nodes"`
+}
+
+// Nodes of the tree below node, empty quadrants included.
+func countNodes(node *BarnesHutNode) int {
+	if node == nil {
+		return 0
+	}
+	count := 1
+	for _, child := range node.quadrants() {
+		count += countNodes(child)
+	}
+	return count
+}
+
+func TestTreeJSON(t *testing.T) {
+	particles := testParticles(60, 9)
+	root := newTree(particles)
+	for _, maxDepth := range []int{0, 2} {
+		path := filepath.Join(t.TempDir(), "tree.json")
+		if err := WriteTreeFile(path, particles, maxDepth); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tree treeJSON
+		if err := json.Unmarshal(data, &tree); err != nil {
+			t.Fatalf("depth limit %d: %v", maxDepth, err)
+		}
+		if tree.Particles != 60 || tree.MaxDepth != maxDepth || tree.Nodes[0].Particles != 60 || math.Abs(*tree.Nodes[0].Mass-totalMass(particles)) > 1e-9 {
+			t.Fatalf("depth limit %d: root of %d particles, mass %v", maxDepth, tree.Nodes[0].Particles, *tree.Nodes[0].Mass)
+		}
+		if maxDepth == 0 && len(tree.Nodes) != countNodes(root) {
+			t.Errorf("%d nodes, the tree has %d", len(tree.Nodes), countNodes(root))
+		}
+
+		// Every node but the root is the child of one node, one level below it, and its
+		// particles are those of its children.
+		parents := make([]int, len(tree.Nodes))
+		ids := make(map[int64]bool)
+		truncated := 0
+		for i, node := range tree.Nodes {
+			if node.Index != i {
+				t.Fatalf("node %d numbered %d", i, node.Index)
+			}
+			if maxDepth > 0 && node.Depth > maxDepth {
+				t.Errorf("node %d at depth %d below the limit", i, node.Depth)
+			}
+			if node.Truncated {
+				truncated++
+				if node.Depth != maxDepth || len(node.Children) > 0 {
+					t.Errorf("truncated node %d at depth %d with %d children", i, node.Depth, len(node.Children))
+				}
+			}
+			if node.ID != nil {
+				ids[*node.ID] = true
+			}
+			sum := 0
+			for _, child := range node.Children {
+				if child <= i || child >= len(tree.Nodes) || parents[child] != 0 || tree.Nodes[child].Depth != node.Depth+1 {
+					t.Fatalf("node %d links to node %d", i, child)
+				}
+				parents[child] = i + 1
+				sum += tree.Nodes[child].Particles
+			}
+			if len(node.Children) > 0 && sum != node.Particles {
+				t.Errorf("node %d has %d particles, its children %d", i, node.Particles, sum)
+			}
+		}
+		for i := 1; i < len(parents); i++ {
+			if parents[i] == 0 {
+				t.Errorf("node %d has no parent", i)
+			}
+		}
+		if maxDepth == 0 && (truncated > 0 || len(ids) != 60) {
+			t.Errorf("%d truncated nodes, %d particle IDs without a depth limit", truncated, len(ids))
+		}
+		if maxDepth > 0 && truncated == 0 {
+			t.Errorf("no node truncated at depth %d", maxDepth)
+		}
+	}
+}
+
+func totalMass(particles []*Particle) float64 {
+	mass := 0.0
+	for _, p := range particles {
+		mass += p.mass
+	}
+	return mass
+}
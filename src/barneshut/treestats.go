@@ -0,0 +1,176 @@
+package barneshut
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"unsafe"
+)
+
+/*
+** The shape of a quadtree after it was built and walked: how deep the particles
+** sit, how many nodes hold nothing, what it costs in memory and how many nodes the
+** force walks used. The root of the pointer tree spans the whole int64 range, so its
+** particles sit far deeper than their spread needs; the ParticleSet tree is fitted to
+** the particles and stops at setLeafSize particles per leaf.
+ */
+type TreeStats struct {
+	Nodes            int     // All nodes, the empty quadrants included.
+	Leaves           int     // Nodes without children holding particles.
+	EmptyNodes       int     // Nodes without children or particles.
+	Particles        int     // Particles in the leaves.
+	MaxDepth         int     // Of the deepest leaf holding particles, 0 for the root.
+	MeanDepth        float64 // Of the leaves, over their particles.
+	MaxLeafParticles int
+	NodesAtDepth     []int // Nodes at each depth, the histogram of the tree's shape.
+	ParticlesAtDepth []int // Particles in the leaves at each depth.
+	MemoryBytes      int64 // Estimate of the tree and the particles, without allocator overhead.
+	Interactions     int64 // Nodes and particles used by the last force calculation, over all particles.
+}
+
+func (stats TreeStats) ParticlesPerLeaf() float64 {
+	if stats.Leaves == 0 {
+		return 0
+	}
+	return float64(stats.Particles) / float64(stats.Leaves)
+}
+
+func (stats TreeStats) InteractionsPerParticle() float64 {
+	if stats.Particles == 0 {
+		return 0
+	}
+	return float64(stats.Interactions) / float64(stats.Particles)
+}
+
+// Counts a node at depth holding n particles, n < 0 for an internal node.
+func (stats *TreeStats) addNode(depth int, n int) {
+	for len(stats.NodesAtDepth) <= depth {
+		stats.NodesAtDepth = append(stats.NodesAtDepth, 0)
+		stats.ParticlesAtDepth = append(stats.ParticlesAtDepth, 0)
+	}
+	stats.Nodes++
+	stats.NodesAtDepth[depth]++
+	switch {
+	case n == 0:
+		stats.EmptyNodes++
+	case n > 0:
+		stats.Leaves++
+		stats.Particles += n
+		stats.ParticlesAtDepth[depth] += n
+		stats.MaxDepth = max(stats.MaxDepth, depth)
+		stats.MaxLeafParticles = max(stats.MaxLeafParticles, n)
+		stats.MeanDepth += float64(depth * n)
+	}
+}
+
+/*
+** The stats of the tree below root, after CalcCenterOfMass or a time-step. The
+** interactions are those ForceCalculation counted in the particles, so they are of the
+** last step that walked this tree.
+ */
+func ComputeTreeStats(root *BarnesHutNode) TreeStats {
+	var stats TreeStats
+	var visit func(node *BarnesHutNode, depth int)
+	visit = func(node *BarnesHutNode, depth int) {
+		if node == nil {
+			return
+		}
+		switch {
+		case node.particle != nil:
+			stats.addNode(depth, 1)
+			stats.Interactions += int64(node.particle.interactions)
+		case node.isLeaf():
+			stats.addNode(depth, 0)
+		default:
+			stats.addNode(depth, -1)
+		}
+		for _, child := range node.quadrants() {
+			visit(child, depth+1)
+		}
+	}
+	visit(root, 0)
+	if stats.Particles > 0 {
+		stats.MeanDepth /= float64(stats.Particles)
+	}
+	stats.MemoryBytes = int64(stats.Nodes)*int64(unsafe.Sizeof(BarnesHutNode{})) + int64(stats.Particles)*int64(unsafe.Sizeof(Particle{}))
+	return stats
+}
+
+/*
+** The stats of the tree the last Step built, with the interactions of its force walk.
+ */
+func (set *ParticleSet) TreeStats() TreeStats {
+	var stats TreeStats
+	tree := &set.tree
+	if len(tree.start) == 0 {
+		return stats
+	}
+	var visit func(node int32, depth int)
+	visit = func(node int32, depth int) {
+		if !tree.isLeaf(node) {
+			stats.addNode(depth, -1)
+			for _, child := range tree.children[node] {
+				if child >= 0 {
+					visit(child, depth+1)
+				}
+			}
+			return
+		}
+		stats.addNode(depth, int(tree.end[node]-tree.start[node]))
+	}
+	visit(0, 0)
+	if stats.Particles > 0 {
+		stats.MeanDepth /= float64(stats.Particles)
+	}
+	// Per node comX, comY, mass and size, start and end, 4 children and the parent;
+	// per particle 7 floats, the index and the Morton key.
+	stats.MemoryBytes = int64(stats.Nodes)*(4*8+2*4+4*4+4) + int64(set.Len())*(7*8+4+8)
+	stats.Interactions = set.interactions
+	return stats
+}
+
+/*
+** One line with the main figures, for a report after every build.
+ */
+func (stats TreeStats) Summary() string {
+	return fmt.Sprintf("nodes %d, leaves %d, empty %d, depth max %d mean %.2f, particles/leaf %.2f, memory %s, interactions/particle %.1f",
+		stats.Nodes, stats.Leaves, stats.EmptyNodes, stats.MaxDepth, stats.MeanDepth, stats.ParticlesPerLeaf(),
+		formatBytes(stats.MemoryBytes), stats.InteractionsPerParticle())
+}
+
+/*
+** Prints the figures and the depth histogram as an aligned table, with a bar of the
+** nodes at each depth.
+ */
+func (stats TreeStats) Fprint(w io.Writer) error {
+	fmt.Fprintf(w, "tree: %d nodes, %d leaves, %d empty, %d particles\n", stats.Nodes, stats.Leaves, stats.EmptyNodes, stats.Particles)
+	fmt.Fprintf(w, "depth: max %d, mean %.2f\n", stats.MaxDepth, stats.MeanDepth)
+	fmt.Fprintf(w, "particles per leaf: mean %.2f, max %d\n", stats.ParticlesPerLeaf(), stats.MaxLeafParticles)
+	fmt.Fprintf(w, "memory: %s\n", formatBytes(stats.MemoryBytes))
+	fmt.Fprintf(w, "interactions per particle: %.1f (%d in all)\n\n", stats.InteractionsPerParticle(), stats.Interactions)
+
+	widest := 0
+	for _, n := range stats.NodesAtDepth {
+		widest = max(widest, n)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "depth\tnodes\tparticles\t")
+	for depth, n := range stats.NodesAtDepth {
+		bar := strings.Repeat("#", (n*40+widest-1)/max(widest, 1))
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%s\n", depth, n, stats.ParticlesAtDepth[depth], bar)
+	}
+	return tw.Flush()
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
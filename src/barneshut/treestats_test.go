@@ -0,0 +1,56 @@
+package barneshut
+
+import (
+	"fmt"
+	"testing"
+)
+
+/*
+** Five particles in the square [0, 8]²: one in each of the top quadrants and the
+** bottom left one, and two in the bottom right one, which is split again with two of
+** its quadrants left empty.
+ */
+func statsParticles() []*Particle {
+	var particles []*Particle
+	for i, xy := range [][2]float64{{1, 7}, {7, 7}, {1, 1}, {5, 1}, {7, 3}} {
+		p := NewParticle(xy[0], xy[1])
+		p.id = int64(i)
+		particles = append(particles, p)
+	}
+	return particles
+}
+
+func TestComputeTreeStats(t *testing.T) {
+	particles := statsParticles()
+	root := CreateNode(0, 8, 0, 8, nil)
+	for _, p := range particles {
+		InsertParticle(root, p)
+	}
+	sched, _ := NewScheduler(SchedulerOptions{Name: SchedulerSequential})
+	// Every quadrant holding particles is too close to be used whole, so each particle
+	// interacts with the 4 others. The two empty quadrants have their center of mass at
+	// the origin and are used whole, with no mass, by all but the particle at (1, 1):
+	// 20 + 8 interactions, every step anew.
+	for step := 1; step <= 2; step++ {
+		RunSimulation(root, sched, 0, len(particles))
+		stats := ComputeTreeStats(root)
+		got := fmt.Sprint(stats.Nodes, stats.Leaves, stats.EmptyNodes, stats.Particles, stats.MaxDepth, stats.MeanDepth,
+			stats.MaxLeafParticles, stats.NodesAtDepth, stats.ParticlesAtDepth, stats.Interactions)
+		if want := "9 5 2 5 2 1.4 1 [1 4 4] [0 3 2] 28"; got != want {
+			t.Errorf("step %d: nodes, leaves, empty, particles, depth, mean depth, per leaf, histograms and interactions %s, want %s", step, got, want)
+		}
+	}
+}
+
+func TestParticleSetTreeStats(t *testing.T) {
+	set := NewParticleSet(statsParticles())
+	// The five particles fit in one leaf, and every particle sums the 4 others in it.
+	for step := 1; step <= 2; step++ {
+		set.Step(0, 1)
+		stats := set.TreeStats()
+		got := fmt.Sprint(stats.Nodes, stats.Leaves, stats.EmptyNodes, stats.Particles, stats.MaxDepth, stats.MaxLeafParticles, stats.Interactions)
+		if want := "1 1 0 5 0 5 20"; got != want {
+			t.Errorf("step %d: nodes, leaves, empty, particles, depth, per leaf and interactions %s, want %s", step, got, want)
+		}
+	}
+}
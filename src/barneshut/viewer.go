@@ -0,0 +1,318 @@
+package barneshut
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//go:embed viewer.html
+var viewerPage []byte
+
+/*
+** Options of a Viewer.
+ */
+type ViewerOptions struct {
+	MaxFPS    float64 // Most frames a second taken from the simulation, 30 if 0.
+	MaxPoints int     // Most particles sent in a frame, 20000 if 0.
+}
+
+/*
+** Live view of a running simulation in the browser: an HTTP server with a canvas
+** page that receives frames as Server-Sent Events.
+**
+** The simulation hands frames to Publish and never waits for the browsers. Publish
+** keeps only the latest frame, and at most MaxFPS of them a second, and every
+** connected page gets the latest frame when it is due. Each page has its own
+** viewport, frame rate and pause state, set through /control, and is sent only the
+** particles in its viewport, thinned to MaxPoints, so zooming into a large run shows
+** every particle there without sending the rest.
+ */
+type Viewer struct {
+	opts ViewerOptions
+
+	mu          sync.Mutex
+	frame       *viewerFrame
+	changed     chan struct{} // Closed and replaced when a frame is published.
+	lastPublish time.Time
+	clients     map[int64]*viewerClient
+	nextClient  int64
+}
+
+// A frame as published, the positions in the order of the particles.
+type viewerFrame struct {
+	step int
+	time float64
+	x, y []float64
+}
+
+// What a page wants to be sent, set by its /control requests.
+type viewerSettings struct {
+	View   []float64 `json:"view"` // minX, maxX, minY, maxY, nil to fit the particles.
+	Width  int       `json:"width"`
+	Height int       `json:"height"`
+	Paused bool      `json:"paused"`
+	FPS    float64   `json:"fps"`
+}
+
+type viewerClient struct {
+	settings viewerSettings
+	poke     chan struct{} // Signalled when the settings change.
+}
+
+func NewViewer(opts ViewerOptions) *Viewer {
+	if opts.MaxFPS <= 0 {
+		opts.MaxFPS = 30
+	}
+	if opts.MaxPoints <= 0 {
+		opts.MaxPoints = 20000
+	}
+	return &Viewer{opts: opts, changed: make(chan struct{}), clients: make(map[int64]*viewerClient)}
+}
+
+/*
+** Whether Publish would take a frame now: a page is connected and playing and the
+** last frame is at least 1/MaxFPS old. Lets the caller skip gathering the particles,
+** e.g. from a ParticleSet, for frames nobody would see.
+ */
+func (viewer *Viewer) Due() bool {
+	viewer.mu.Lock()
+	defer viewer.mu.Unlock()
+	if time.Since(viewer.lastPublish) < time.Duration(float64(time.Second)/viewer.opts.MaxFPS) {
+		return false
+	}
+	for _, client := range viewer.clients {
+		if !client.settings.Paused {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+** Makes the particles after the step the latest frame if it is Due. Copies the
+** positions and returns, the pages are sent the frame by their own goroutines.
+ */
+func (viewer *Viewer) Publish(step int, time float64, particles []*Particle) {
+	if !viewer.Due() {
+		return
+	}
+	viewer.publish(step, time, particles)
+}
+
+// Makes the particles the latest frame whether it is due or not.
+func (viewer *Viewer) publish(step int, t float64, particles []*Particle) {
+	frame := &viewerFrame{step: step, time: t, x: make([]float64, len(particles)), y: make([]float64, len(particles))}
+	for i, p := range particles {
+		frame.x[i], frame.y[i] = p.x, p.y
+	}
+	viewer.mu.Lock()
+	defer viewer.mu.Unlock()
+	viewer.frame = frame
+	viewer.lastPublish = time.Now()
+	close(viewer.changed)
+	viewer.changed = make(chan struct{})
+}
+
+/*
+** Makes the particles the latest frame even if it is not due, e.g. the initial and
+** final states, so pages that connect later still see them.
+ */
+func (viewer *Viewer) Show(step int, time float64, particles []*Particle) {
+	viewer.publish(step, time, particles)
+}
+
+/*
+** The viewer's routes: the page at /, the frames at /events and the settings of a
+** page at /control.
+ */
+func (viewer *Viewer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(viewerPage)
+	})
+	mux.HandleFunc("GET /events", viewer.serveEvents)
+	mux.HandleFunc("POST /control", viewer.serveControl)
+	return mux
+}
+
+/*
+** Serves the viewer on addr until ctx is done and returns the address it listens on.
+** The listener is opened before it returns, so a port in use is reported at once.
+ */
+func (viewer *Viewer) ListenAndServe(ctx context.Context, addr string) (net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: viewer.Handler(), BaseContext: func(net.Listener) context.Context { return ctx }}
+	go server.Serve(listener)
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	return listener.Addr(), nil
+}
+
+/*
+** Streams frames to a page: first a hello event with the page's ID for /control,
+** then a frame event whenever a newer frame or new settings are due.
+ */
+func (viewer *Viewer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	client := &viewerClient{settings: viewerSettings{FPS: 10}, poke: make(chan struct{}, 1)}
+	viewer.mu.Lock()
+	id := viewer.nextClient
+	viewer.nextClient++
+	viewer.clients[id] = client
+	viewer.mu.Unlock()
+	defer func() {
+		viewer.mu.Lock()
+		delete(viewer.clients, id)
+		viewer.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "event: hello\ndata: {\"client\": %d}\n\n", id)
+	out.Flush()
+	flusher.Flush()
+
+	var shown *viewerFrame // The last frame sent, kept while the page is paused.
+	var lastSent time.Time
+	dirty := false // The settings changed since the last frame sent.
+	for {
+		viewer.mu.Lock()
+		frame, changed, settings := viewer.frame, viewer.changed, client.settings
+		viewer.mu.Unlock()
+		if settings.Paused {
+			// A paused page is only sent its frame again, e.g. in a new viewport.
+			frame = shown
+		}
+
+		if frame != nil && (frame != shown || dirty) {
+			// New settings are answered at once, new frames at the page's rate.
+			wait := time.Until(lastSent.Add(time.Duration(float64(time.Second) / settings.FPS)))
+			if wait > 0 && !dirty {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-client.poke:
+					dirty = true
+				case <-time.After(wait):
+				}
+				continue // Send the latest frame, not the one seen before waiting.
+			}
+			writeViewerFrame(out, frame, settings, viewer.opts.MaxPoints)
+			if out.Flush() != nil {
+				return
+			}
+			flusher.Flush()
+			shown, lastSent, dirty = frame, time.Now(), false
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-client.poke:
+			dirty = true
+		}
+	}
+}
+
+/*
+** Writes the frame as an event of the particles in the page's viewport, fitting one
+** to the particles if the page has none. Every k-th particle is sent when more than
+** maxPoints are in view, the same ones from frame to frame.
+ */
+func writeViewerFrame(out *bufio.Writer, frame *viewerFrame, settings viewerSettings, maxPoints int) {
+	var minX, maxX, minY, maxY float64
+	if len(settings.View) == 4 {
+		minX, maxX, minY, maxY = settings.View[0], settings.View[1], settings.View[2], settings.View[3]
+	} else {
+		particles := make([]*Particle, len(frame.x))
+		for i := range particles {
+			particles[i] = &Particle{x: frame.x[i], y: frame.y[i]}
+		}
+		fit := RenderOptions{Width: settings.Width, Height: settings.Height}.FitViewport(particles)
+		minX, maxX, minY, maxY = fit.MinX, fit.MaxX, fit.MinY, fit.MaxY
+	}
+
+	var inView []int
+	for i := range frame.x {
+		if frame.x[i] >= minX && frame.x[i] <= maxX && frame.y[i] >= minY && frame.y[i] <= maxY {
+			inView = append(inView, i)
+		}
+	}
+	stride := (len(inView) + maxPoints - 1) / max(maxPoints, 1)
+	stride = max(stride, 1)
+
+	fmt.Fprintf(out, "event: frame\ndata: {\"step\": %d, \"time\": %s, \"particles\": %d, \"inView\": %d, \"view\": [%s, %s, %s, %s], \"xy\": [",
+		frame.step, jsonFloat(frame.time), len(frame.x), len(inView), jsonFloat(minX), jsonFloat(maxX), jsonFloat(minY), jsonFloat(maxY))
+	for k := 0; k < len(inView); k += stride {
+		if k > 0 {
+			out.WriteByte(',')
+		}
+		i := inView[k]
+		out.WriteString(strconv.FormatFloat(frame.x[i], 'g', 7, 64))
+		out.WriteByte(',')
+		out.WriteString(strconv.FormatFloat(frame.y[i], 'g', 7, 64))
+	}
+	out.WriteString("]}\n\n")
+}
+
+/*
+** Sets the viewport, size, pause state and frame rate of a page:
+**
+**	POST /control {"client": 0, "view": [minX, maxX, minY, maxY], "width": 800,
+**	               "height": 600, "paused": false, "fps": 10}
+**
+** A missing or null view fits the particles of every frame.
+ */
+func (viewer *Viewer) serveControl(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Client int64 `json:"client"`
+		viewerSettings
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	settings := request.viewerSettings
+	if settings.View != nil && (len(settings.View) != 4 || !(settings.View[0] < settings.View[1]) || !(settings.View[2] < settings.View[3])) {
+		http.Error(w, "view must be [minX, maxX, minY, maxY]", http.StatusBadRequest)
+		return
+	}
+	settings.FPS = min(max(settings.FPS, 0.1), viewer.opts.MaxFPS)
+	settings.Width, settings.Height = min(max(settings.Width, 1), 8192), min(max(settings.Height, 1), 8192)
+
+	viewer.mu.Lock()
+	client := viewer.clients[request.Client]
+	if client != nil {
+		client.settings = settings
+	}
+	viewer.mu.Unlock()
+	if client == nil {
+		http.Error(w, "unknown client", http.StatusNotFound)
+		return
+	}
+	select {
+	case client.poke <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
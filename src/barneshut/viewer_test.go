@@ -0,0 +1,146 @@
+package barneshut
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type viewerEvent struct {
+	name string
+	data struct {
+		Client    int64     `json:"client"`
+		Step      int       `json:"step"`
+		Particles int       `json:"particles"`
+		InView    int       `json:"inView"`
+		XY        []float64 `json:"xy"`
+	}
+	at time.Time
+}
+
+// Reads the events of an /events stream into a channel, until it ends.
+func readViewerEvents(t *testing.T, server *httptest.Server) <-chan viewerEvent {
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	events := make(chan viewerEvent, 16)
+	go func() {
+		defer close(events)
+		in := bufio.NewScanner(resp.Body)
+		in.Buffer(nil, 1<<20)
+		var event viewerEvent
+		for in.Scan() {
+			line := in.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.data)
+			case line == "":
+				event.at = time.Now()
+				events <- event
+				event = viewerEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+func nextViewerEvent(t *testing.T, events <-chan viewerEvent, name string) viewerEvent {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok || event.name != name {
+			t.Fatalf("got event %q, want %q", event.name, name)
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %s event", name)
+	}
+	return viewerEvent{}
+}
+
+func postViewerControl(t *testing.T, server *httptest.Server, body string) int {
+	t.Helper()
+	resp, err := http.Post(server.URL+"/control", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestViewerEvents(t *testing.T) {
+	viewer := NewViewer(ViewerOptions{MaxFPS: 100})
+	server := httptest.NewServer(viewer.Handler())
+	// Registered first, so it runs after the streams are closed, which it waits for.
+	t.Cleanup(server.Close)
+	particles := []*Particle{NewParticle(0, 0), NewParticle(1, 1), NewParticle(10, 10), NewParticle(20, 20)}
+
+	events := readViewerEvents(t, server)
+	client := nextViewerEvent(t, events, "hello").data.Client
+	viewer.Show(0, 0, particles)
+	if frame := nextViewerEvent(t, events, "frame"); frame.data.Step != 0 || frame.data.InView != 4 || len(frame.data.XY) != 8 {
+		t.Fatalf("first frame: step %d, %d of %d particles in view, %d coordinates", frame.data.Step, frame.data.InView, frame.data.Particles, len(frame.data.XY))
+	}
+
+	// New settings are answered at once with the frame in the new viewport.
+	if status := postViewerControl(t, server, fmt.Sprintf(`{"client": %d, "view": [-1, 2, -1, 2], "fps": 2}`, client)); status != http.StatusNoContent {
+		t.Fatalf("control: status %d", status)
+	}
+	frame := nextViewerEvent(t, events, "frame")
+	if frame.data.Step != 0 || frame.data.Particles != 4 || frame.data.InView != 2 || fmt.Sprint(frame.data.XY) != "[0 0 1 1]" {
+		t.Fatalf("frame in view: step %d, %d of %d particles, %v", frame.data.Step, frame.data.InView, frame.data.Particles, frame.data.XY)
+	}
+
+	// At 2 frames a second the page gets the latest of three frames half a second later.
+	for step := 1; step <= 3; step++ {
+		viewer.Show(step, float64(step), particles)
+	}
+	throttled := nextViewerEvent(t, events, "frame")
+	if throttled.data.Step != 3 || throttled.at.Sub(frame.at) < 400*time.Millisecond {
+		t.Fatalf("frame of step %d %v after the last, want step 3 after 500ms", throttled.data.Step, throttled.at.Sub(frame.at))
+	}
+
+	// A paused page is sent its frame again in a new viewport, but no new frames.
+	postViewerControl(t, server, fmt.Sprintf(`{"client": %d, "view": [5, 25, 5, 25], "paused": true, "fps": 10}`, client))
+	if paused := nextViewerEvent(t, events, "frame"); paused.data.Step != 3 || paused.data.InView != 2 {
+		t.Fatalf("paused frame: step %d, %d particles in view", paused.data.Step, paused.data.InView)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if viewer.Due() {
+		t.Error("a frame is due with the only page paused")
+	}
+	viewer.Show(4, 4, particles)
+	select {
+	case event := <-events:
+		t.Fatalf("paused page sent %s of step %d", event.name, event.data.Step)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	if status := postViewerControl(t, server, `{"client": 99}`); status != http.StatusNotFound {
+		t.Errorf("unknown client: status %d", status)
+	}
+	if status := postViewerControl(t, server, fmt.Sprintf(`{"client": %d, "view": [1, 0, 0, 1]}`, client)); status != http.StatusBadRequest {
+		t.Errorf("empty view: status %d", status)
+	}
+}
+
+func TestViewerThinsFrames(t *testing.T) {
+	viewer := NewViewer(ViewerOptions{MaxPoints: 10})
+	server := httptest.NewServer(viewer.Handler())
+	t.Cleanup(server.Close)
+	events := readViewerEvents(t, server)
+	nextViewerEvent(t, events, "hello")
+	viewer.Show(0, 0, testParticles(95, 1))
+	if frame := nextViewerEvent(t, events, "frame"); frame.data.InView != 95 || len(frame.data.XY) != 2*10 {
+		t.Errorf("%d particles in view sent as %d points, want every 10th", frame.data.InView, len(frame.data.XY)/2)
+	}
+}
@@ -0,0 +1,253 @@
+package barneshut
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+/*
+** VTK XML files for ParaView: the particles as PolyData (.vtp), the quadtree cells as
+** an UnstructuredGrid (.vtu), and a collection (.pvd) tying the files of a run to
+** their times. The data is written as ASCII so the files stay readable and need no
+** byte order or header size conventions.
+ */
+
+// VTK_QUAD, the cell type of the quadtree cells.
+const vtkQuad = 9
+
+/*
+** Writes the particles as VTK PolyData with one vertex per particle. The point data
+** holds the id, the velocity, the acceleration of the last step and the mass, and the
+** field data the time and step of the header, which ParaView picks up as TimeValue.
+ */
+func WriteVTKParticles(w io.Writer, header SnapshotHeader, particles []*Particle) error {
+	out := bufio.NewWriter(w)
+	sorted := sortedByID(particles)
+	n := len(sorted)
+	fmt.Fprintln(out, `<?xml version="1.0"?>`)
+	fmt.Fprintln(out, `<VTKFile type="PolyData" version="1.0" byte_order="LittleEndian">`)
+	fmt.Fprintln(out, `<PolyData>`)
+	writeVTKFieldData(out, header)
+	fmt.Fprintf(out, "<Piece NumberOfPoints=\"%d\" NumberOfVerts=\"%d\" NumberOfLines=\"0\" NumberOfStrips=\"0\" NumberOfPolys=\"0\">\n", n, n)
+
+	fmt.Fprintln(out, `<PointData Scalars="mass" Vectors="velocity">`)
+	writeVTKArray(out, "Int64", "id", 1, n, func(i, c int) string { return strconv.FormatInt(sorted[i].id, 10) })
+	writeVTKArray(out, "Float64", "velocity", 3, n, func(i, c int) string {
+		return vtkVector(sorted[i].vx, sorted[i].vy, c)
+	})
+	writeVTKArray(out, "Float64", "acceleration", 3, n, func(i, c int) string {
+		return vtkVector(sorted[i].fx, sorted[i].fy, c)
+	})
+	writeVTKArray(out, "Float64", "mass", 1, n, func(i, c int) string { return formatFloat(sorted[i].mass) })
+	fmt.Fprintln(out, `</PointData>`)
+
+	fmt.Fprintln(out, `<Points>`)
+	writeVTKArray(out, "Float64", "Points", 3, n, func(i, c int) string { return vtkVector(sorted[i].x, sorted[i].y, c) })
+	fmt.Fprintln(out, `</Points>`)
+
+	fmt.Fprintln(out, `<Verts>`)
+	writeVTKArray(out, "Int64", "connectivity", 1, n, func(i, c int) string { return strconv.Itoa(i) })
+	writeVTKArray(out, "Int64", "offsets", 1, n, func(i, c int) string { return strconv.Itoa(i + 1) })
+	fmt.Fprintln(out, `</Verts>`)
+
+	fmt.Fprintln(out, `</Piece>`)
+	fmt.Fprintln(out, `</PolyData>`)
+	fmt.Fprintln(out, `</VTKFile>`)
+	return out.Flush()
+}
+
+// A quadtree cell, clipped to the bounds of the particles.
+type vtkCell struct {
+	minX, maxX, minY, maxY float64
+	depth                  int
+	particles              int
+	mass                   float64
+}
+
+/*
+** Writes the cells of the quadtree of the particles as a VTK UnstructuredGrid of quads,
+** with the depth, particle count and mass of every cell as cell data. The root spans
+** the whole float range, so the cells are clipped to the bounds of the particles, and
+** a cell that clips to the same rectangle as its parent is left out. Empty quadrants
+** are left out too.
+ */
+func WriteVTKTree(w io.Writer, header SnapshotHeader, particles []*Particle) error {
+	var cells []vtkCell
+	if len(particles) > 0 {
+		cells, _, _ = appendVTKCells(newTree(particles), 0, particleBounds(particles), vtkCell{minX: 1, maxX: 0}, cells)
+	}
+
+	out := bufio.NewWriter(w)
+	n := len(cells)
+	fmt.Fprintln(out, `<?xml version="1.0"?>`)
+	fmt.Fprintln(out, `<VTKFile type="UnstructuredGrid" version="1.0" byte_order="LittleEndian">`)
+	fmt.Fprintln(out, `<UnstructuredGrid>`)
+	writeVTKFieldData(out, header)
+	fmt.Fprintf(out, "<Piece NumberOfPoints=\"%d\" NumberOfCells=\"%d\">\n", 4*n, n)
+
+	fmt.Fprintln(out, `<CellData Scalars="depth">`)
+	writeVTKArray(out, "Int32", "depth", 1, n, func(i, c int) string { return strconv.Itoa(cells[i].depth) })
+	writeVTKArray(out, "Int64", "particles", 1, n, func(i, c int) string { return strconv.Itoa(cells[i].particles) })
+	writeVTKArray(out, "Float64", "mass", 1, n, func(i, c int) string { return formatFloat(cells[i].mass) })
+	fmt.Fprintln(out, `</CellData>`)
+
+	fmt.Fprintln(out, `<Points>`)
+	writeVTKArray(out, "Float64", "Points", 3, 4*n, func(i, c int) string {
+		cell := cells[i/4]
+		// Corners counter-clockwise from the bottom left.
+		x := [4]float64{cell.minX, cell.maxX, cell.maxX, cell.minX}[i%4]
+		y := [4]float64{cell.minY, cell.minY, cell.maxY, cell.maxY}[i%4]
+		return vtkVector(x, y, c)
+	})
+	fmt.Fprintln(out, `</Points>`)
+
+	fmt.Fprintln(out, `<Cells>`)
+	writeVTKArray(out, "Int64", "connectivity", 1, 4*n, func(i, c int) string { return strconv.Itoa(i) })
+	writeVTKArray(out, "Int64", "offsets", 1, n, func(i, c int) string { return strconv.Itoa(4 * (i + 1)) })
+	writeVTKArray(out, "UInt8", "types", 1, n, func(i, c int) string { return strconv.Itoa(vtkQuad) })
+	fmt.Fprintln(out, `</Cells>`)
+
+	fmt.Fprintln(out, `</Piece>`)
+	fmt.Fprintln(out, `</UnstructuredGrid>`)
+	fmt.Fprintln(out, `</VTKFile>`)
+	return out.Flush()
+}
+
+/*
+** Appends the non-empty cells below node in pre-order, skipping those that clip to the
+** rectangle of parent, the last cell appended above them. Returns the number of
+** particles and the mass below node too.
+ */
+func appendVTKCells(node *BarnesHutNode, depth int, bounds rankBounds, parent vtkCell, cells []vtkCell) ([]vtkCell, int, float64) {
+	if node == nil {
+		return cells, 0, 0
+	}
+	cell := vtkCell{
+		minX: max(node.leftX, bounds.MinX), maxX: min(node.rightX, bounds.MaxX),
+		minY: max(node.botY, bounds.MinY), maxY: min(node.topY, bounds.MaxY),
+		depth: depth,
+	}
+	index := -1
+	if cell.minX != parent.minX || cell.maxX != parent.maxX || cell.minY != parent.minY || cell.maxY != parent.maxY {
+		index = len(cells)
+		cells = append(cells, cell)
+		parent = cell
+	}
+	count, mass := 0, 0.0
+	if node.particle != nil {
+		count, mass = 1, node.particle.mass
+	}
+	for _, child := range node.quadrants() {
+		var c int
+		var m float64
+		cells, c, m = appendVTKCells(child, depth+1, bounds, parent, cells)
+		count, mass = count+c, mass+m
+	}
+	if index >= 0 {
+		if count == 0 {
+			return cells[:index], 0, 0 // An empty quadrant.
+		}
+		cells[index].particles, cells[index].mass = count, mass
+	}
+	return cells, count, mass
+}
+
+func writeVTKFieldData(out *bufio.Writer, header SnapshotHeader) {
+	fmt.Fprintln(out, `<FieldData>`)
+	fmt.Fprintf(out, "<DataArray type=\"Float64\" Name=\"TimeValue\" NumberOfTuples=\"1\" format=\"ascii\">%s</DataArray>\n", formatFloat(header.Time))
+	fmt.Fprintf(out, "<DataArray type=\"Int64\" Name=\"Step\" NumberOfTuples=\"1\" format=\"ascii\">%d</DataArray>\n", header.Step)
+	fmt.Fprintln(out, `</FieldData>`)
+}
+
+// Writes an ASCII DataArray of n tuples, one per line.
+func writeVTKArray(out *bufio.Writer, kind string, name string, components int, n int, value func(i, c int) string) {
+	fmt.Fprintf(out, "<DataArray type=\"%s\" Name=\"%s\" NumberOfComponents=\"%d\" format=\"ascii\">\n", kind, name, components)
+	for i := 0; i < n; i++ {
+		for c := 0; c < components; c++ {
+			if c > 0 {
+				out.WriteByte(' ')
+			}
+			out.WriteString(value(i, c))
+		}
+		out.WriteByte('\n')
+	}
+	fmt.Fprintln(out, `</DataArray>`)
+}
+
+// Component c of the 3D vector (x, y, 0).
+func vtkVector(x, y float64, c int) string {
+	switch c {
+	case 0:
+		return formatFloat(x)
+	case 1:
+		return formatFloat(y)
+	}
+	return "0"
+}
+
+/*
+** Writes the particles to a .vtp file, replacing the file.
+ */
+func WriteVTKParticlesFile(path string, header SnapshotHeader, particles []*Particle) error {
+	return writeVTKFile(path, func(w io.Writer) error { return WriteVTKParticles(w, header, particles) })
+}
+
+/*
+** Writes the quadtree cells of the particles to a .vtu file, replacing the file.
+ */
+func WriteVTKTreeFile(path string, header SnapshotHeader, particles []*Particle) error {
+	return writeVTKFile(path, func(w io.Writer) error { return WriteVTKTree(w, header, particles) })
+}
+
+func writeVTKFile(path string, write func(w io.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+/*
+** A file of a time series in a .pvd collection. Files of the same time with different
+** parts, e.g. the particles and the tree, are loaded together.
+ */
+type PVDEntry struct {
+	Time float64
+	Part int
+	File string
+}
+
+/*
+** Writes a .pvd collection of the entries, replacing the file atomically so ParaView
+** never reads a partial one. Files are made relative to the collection's directory.
+ */
+func WritePVD(path string, entries []PVDEntry) error {
+	dir := filepath.Dir(path)
+	return WriteFileAtomic(path, func(w io.Writer) error {
+		out := bufio.NewWriter(w)
+		fmt.Fprintln(out, `<?xml version="1.0"?>`)
+		fmt.Fprintln(out, `<VTKFile type="Collection" version="0.1" byte_order="LittleEndian">`)
+		fmt.Fprintln(out, `<Collection>`)
+		for _, entry := range entries {
+			file := entry.File
+			if rel, err := filepath.Rel(dir, file); err == nil {
+				file = rel
+			}
+			fmt.Fprintf(out, "<DataSet timestep=\"%s\" part=\"%d\" file=\"", formatFloat(entry.Time), entry.Part)
+			xml.EscapeText(out, []byte(filepath.ToSlash(file)))
+			fmt.Fprintln(out, `"/>`)
+		}
+		fmt.Fprintln(out, `</Collection>`)
+		fmt.Fprintln(out, `</VTKFile>`)
+		return out.Flush()
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"barnes-hut-parallel/src/barneshut"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+/*
+** Prints a summary of binary or .npz snapshots: the header, the range and mean of
+** every column, and the conserved quantities.
+**
+**	go run ./src/inspect [-head n] snapshot.bhs|snapshot.npz...
+ */
+func main() {
+	head := flag.Int("head", 0, "also print the first n particles")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: inspect [-head n] snapshot.bhs|snapshot.npz...")
+		os.Exit(2)
+	}
+
+	failed := false
+	for i, path := range flag.Args() {
+		if i > 0 {
+			fmt.Println()
+		}
+		var snapshot *barneshut.Snapshot
+		var err error
+		if strings.EqualFold(filepath.Ext(path), ".npz") {
+			snapshot, err = barneshut.ReadNPZFile(path)
+		} else {
+			snapshot, err = barneshut.ReadBinarySnapshotFile(path)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
+		}
+		printSummary(path, snapshot, *head)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func printSummary(path string, snapshot *barneshut.Snapshot, head int) {
+	fmt.Print(path + ":")
+	if snapshot.Version > 0 {
+		fmt.Printf(" version %d", snapshot.Version)
+	} else {
+		fmt.Print(" npz archive")
+	}
+	if snapshot.Options.Float32 {
+		fmt.Print(", float32")
+	}
+	if snapshot.Options.Deflate {
+		fmt.Print(", deflate")
+	}
+	fmt.Printf("\nstep %d, time %s, %d particles\n", snapshot.Header.Step, format(snapshot.Header.Time), snapshot.Len())
+
+	keys := make([]string, 0, len(snapshot.Header.Params))
+	for key := range snapshot.Header.Params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("  %s=%s\n", key, snapshot.Header.Params[key])
+	}
+	if snapshot.Len() == 0 {
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "column\tmin\tmax\tmean\t")
+	names := []string{"x", "y", "vx", "vy", "ax", "ay", "mass"}
+	for c, column := range [][]float64{snapshot.X, snapshot.Y, snapshot.VX, snapshot.VY, snapshot.AX, snapshot.AY, snapshot.Mass} {
+		lo, hi, sum := math.Inf(1), math.Inf(-1), 0.0
+		for _, v := range column {
+			lo, hi, sum = min(lo, v), max(hi, v), sum+v
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\n", names[c], format(lo), format(hi), format(sum/float64(len(column))))
+	}
+	w.Flush()
+
+	var mass, comX, comY, px, py, kinetic float64
+	for i := 0; i < snapshot.Len(); i++ {
+		m := snapshot.Mass[i]
+		mass += m
+		comX += m * snapshot.X[i]
+		comY += m * snapshot.Y[i]
+		px += m * snapshot.VX[i]
+		py += m * snapshot.VY[i]
+		kinetic += 0.5 * m * (snapshot.VX[i]*snapshot.VX[i] + snapshot.VY[i]*snapshot.VY[i])
+	}
+	fmt.Printf("total mass %s, center of mass (%s, %s)\n", format(mass), format(comX/mass), format(comY/mass))
+	fmt.Printf("momentum (%s, %s), kinetic energy %s\n", format(px), format(py), format(kinetic))
+
+	if head > 0 {
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "id\tx\ty\tvx\tvy\tax\tay\tmass\t")
+		for i := 0; i < min(head, snapshot.Len()); i++ {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", snapshot.ID[i], format(snapshot.X[i]), format(snapshot.Y[i]),
+				format(snapshot.VX[i]), format(snapshot.VY[i]), format(snapshot.AX[i]), format(snapshot.AY[i]), format(snapshot.Mass[i]))
+		}
+		w.Flush()
+	}
+}
+
+func format(v float64) string {
+	return strconv.FormatFloat(v, 'g', 6, 64)
+}
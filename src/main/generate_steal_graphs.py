@@ -0,0 +1,49 @@
+import matplotlib.pyplot as plt
+import subprocess
+
+testRepeat = 1
+
+requestSize = 50000
+threads = [2, 4, 6, 8, 12]
+victims = ['roundrobin', 'random', 'backoff', 'hierarchical']
+batches = [False, True]
+
+# Sequential runtime for the baseline
+sequentialTime = 0.0
+for i in range(testRepeat):
+    result = subprocess.check_output(['go', 'run', 'main.go', str(requestSize)])
+    sequentialTime += float(result.decode('utf-8'))
+sequentialTime = sequentialTime/testRepeat
+print(f'Sequential Time for {requestSize}: {sequentialTime}')
+
+speedup = dict()
+
+# Loop through the victim policies with and without batch stealing and find the speedups for each thread count
+for victim in victims:
+    for batch in batches:
+        policy = victim + (' + batch' if batch else '')
+        speedup[policy] = {}
+        for thread in threads:
+            time = 0.0
+            for i in range(testRepeat):
+                result = subprocess.check_output(['go', 'run', 'main.go', '-victim=' + victim, '-batch=' + str(batch).lower(), str(requestSize), str(thread)])
+                time += float(result.decode('utf-8'))
+            time = time/testRepeat
+            speedup[policy][thread] = sequentialTime/time
+            print(f'Speedup for {policy} with {thread} threads: {speedup[policy][thread]}')
+
+# Plot graphs and store in steal-speedup-graph.png
+for policy in speedup:
+    y1 = []
+    for thread in threads:
+        y1.append(speedup[policy][thread])
+    plt.plot(threads, y1, label=policy)
+
+plot_title = "Work Stealing Victim Selection (" + str(requestSize) + " Particles)"
+
+plt.xlabel("No. of Threads")
+plt.ylabel("Speedup")
+plt.title(plot_title)
+plt.legend()
+# plt.show()
+plt.savefig('steal-speedup-graph.png')
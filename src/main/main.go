@@ -2,11 +2,18 @@ package main
 
 import (
 	"barnes-hut-parallel/src/barneshut"
+	"context"
+	"flag"
 	"fmt"
 	"math"
 	"math/rand"
+	"net"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
 
 	// "proj3-redesigned/barneshut"
 	"runtime"
@@ -32,35 +39,104 @@ func main() {
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	// Flags go before the positional arguments.
+	schedulerName := flag.String("scheduler", barneshut.SchedulerWorkStealing, "parallel strategy: sequential, goroutine, worksteal, static or costzones")
+	victim := flag.String("victim", barneshut.VictimRoundRobin, "work stealing victim selection: roundrobin, random, backoff or hierarchical")
+	batchSteal := flag.Bool("batch", false, "steal half of the victim's deque at once")
+	subtreeCutoff := flag.Int("cutoff", 0, "largest subtree, in particles, run as one work stealing task (0 = tuned from particles and threads, -1 = one task per node)")
+	depthCutoff := flag.Int("depth-cutoff", 0, "tree depth from which subtrees are run as one work stealing task (0 = no depth limit)")
+	timeout := flag.Duration("timeout", 0, "stop the simulation after this long, keeping the last completed iteration (0 = no limit)")
+	seed := flag.Int64("seed", 0, "seed for the random particles, runs with the same seed start identically (0 = random)")
+	exact := flag.Bool("exact", false, "write the .dat files with full float64 precision")
+	checksum := flag.Bool("checksum", false, "print a checksum of the final particle state to stderr")
+	layout := flag.String("layout", "tree", "particle storage: tree (particles reached through the quadtree) or soa (structure of arrays in Morton order)")
+	walk := flag.String("walk", barneshut.WalkParticle, "force walk of the soa layout: particle, group or dualtree")
+	clusters := flag.Int("clusters", 0, "generate the particles in this many gaussian clusters instead of uniformly (0 = uniform)")
+	input := flag.String("input", "", "load the initial particles from this file instead of generating them (see -input-format)")
+	inputFormat := flag.String("input-format", "", "format of -input: text, csv, json, binary or gadget (default: from the file extension, text otherwise)")
+	gadgetLength := flag.Float64("gadget-length", 1, "length of one GADGET length unit in simulation units, for -input and -snapshot GADGET files")
+	gadgetVelocity := flag.Float64("gadget-velocity", 1, "velocity of one GADGET velocity unit in simulation units")
+	gadgetMass := flag.Float64("gadget-mass", 0, "mass of one GADGET mass unit in simulation units (0 = the one that keeps G = 1 consistent with GADGET's G)")
+	gadgetFormat := flag.Int("gadget-format", 2, "GADGET snapshot format written, 1 or 2")
+	gadgetDouble := flag.Bool("gadget-double", false, "write GADGET snapshots in double precision")
+	snapshot := flag.String("snapshot", "", "write the final state with IDs, velocities, accelerations and masses to this file, binary if it ends in .bhs, VTK PolyData if it ends in .vtp, NumPy arrays if it ends in .npz or .npy, GADGET if it ends in .gadget")
+	snapshotEvery := flag.Int("snapshot-every", 0, "also write a snapshot every this many iterations, numbered by iteration (0 = final only)")
+	snapshotFloat32 := flag.Bool("snapshot-float32", false, "store the floats of binary snapshots as float32")
+	snapshotDeflate := flag.Bool("snapshot-deflate", false, "compress binary snapshots with deflate")
+	snapshotTree := flag.Bool("snapshot-tree", false, "also write the quadtree cells of .vtp snapshots as a VTK grid, e.g. snap_tree.vtu")
+	checkpoint := flag.String("checkpoint", "", "write the final state to this file, replaced atomically, for -restart, and checkpoints during the run with -checkpoint-every or -checkpoint-interval")
+	checkpointEvery := flag.Int("checkpoint-every", 0, "write a checkpoint every this many iterations (0 = off)")
+	checkpointInterval := flag.Duration("checkpoint-interval", 0, "write a checkpoint when this long has passed since the last one, e.g. 10m (0 = off)")
+	restart := flag.String("restart", "", "continue the run saved in this checkpoint, with its particles, dt, seed, layout, walk and iterations (unless given by -iterations or the third argument)")
+	iterations := flag.Int("iterations", 0, "number of iterations, instead of the third argument, e.g. to extend a -restart (0 = from the argument)")
+	trajectory := flag.String("trajectory", "", "append a frame of the positions to this trajectory file every -trajectory-every iterations")
+	trajectoryEvery := flag.Int("trajectory-every", 1, "iterations between trajectory frames")
+	trajectoryStride := flag.Int("trajectory-stride", 1, "only write the particles whose ID is a multiple of this to the trajectory")
+	trajectoryVelocities := flag.Bool("trajectory-velocities", false, "also write the velocities to the trajectory")
+	render := flag.String("render", "", "render the final particles to this PNG file, and frames numbered by iteration with -render-every")
+	renderEvery := flag.Int("render-every", 0, "also render a frame every this many iterations (0 = final only)")
+	renderSize := flag.String("render-size", "800x800", "size of the rendered frames in pixels, WIDTHxHEIGHT")
+	renderView := flag.String("render-view", "", "viewport of the rendered frames, minX,maxX,minY,maxY (default: the initial particles' bounds)")
+	renderPoint := flag.Int("render-point", 1, "diameter of a rendered particle in pixels")
+	renderColor := flag.String("render-color", "", "color rendered particles by speed or mass (default: a single color)")
+	renderDensity := flag.Bool("render-density", false, "shade rendered pixels by the log of the number of particles on them")
+	svg := flag.String("svg", "", "draw the final particles and quadtree cells to this SVG file, with the -render-size and -render-view")
+	svgHighlight := flag.String("svg-highlight", "", "show which cells the force walk of the particle with this ID opened and approximated")
+	svgLabels := flag.Bool("svg-labels", false, "write the particle IDs into the SVG")
+	svgCells := flag.Bool("svg-cells", true, "draw the quadtree cells into the SVG")
+	treeDump := flag.String("tree-dump", "", "write the quadtree of the final particles to this .json or Graphviz .dot file")
+	treeDepth := flag.Int("tree-depth", 0, "levels of the quadtree below the root in -tree-dump, 0 for all")
+	movie := flag.String("movie", "", "record the run into this animated GIF, or numbered PNG sequence if it ends in .png, with the -render options; a GIF holds every frame in memory until the end, a byte per pixel (625 KiB a frame at 800x800), so long runs are better recorded as PNGs")
+	movieEvery := flag.Int("movie-every", 1, "iterations between movie frames")
+	movieFPS := flag.Float64("movie-fps", 10, "frames per second of the movie")
+	movieTrack := flag.Bool("movie-track", false, "keep the center of mass in the middle of the movie")
+	movieAnnotate := flag.Bool("movie-annotate", true, "draw the step and time into each movie frame")
+	viewerAddr := flag.String("viewer", "", "serve a live view of the run in the browser on this address, e.g. localhost:8080 (the visual mode's default)")
+	viewerFPS := flag.Float64("viewer-fps", 30, "most frames a second the viewer takes from the simulation")
+	viewerPoints := flag.Int("viewer-points", 20000, "most particles the viewer sends in a frame")
+	viewerLinger := flag.Bool("viewer-linger", false, "after the run, keep serving the final state in -viewer until Ctrl-C (default: only in the visual mode)")
+	term := flag.Bool("term", false, "draw a live density map of the particles in the terminal, on stderr, e.g. over SSH")
+	termEvery := flag.Int("term-every", 10, "iterations between terminal maps")
+	termSize := flag.String("term-size", "", "size of the terminal map with its status lines, COLUMNSxROWS, e.g. $(tput cols)x$(tput lines) (default: $COLUMNS and $LINES if exported, which most shells do not, else 80x24)")
+	termMode := flag.String("term-mode", barneshut.TerminalBraille, "characters of the terminal map: braille or blocks")
+	printTreeStats := flag.Bool("tree-stats", false, "print the shape of the quadtree after every build and a depth histogram of the last one to stderr")
+	printStats := flag.Bool("stats", false, "print per-worker scheduler statistics to stderr after the run, or with -layout soa the nodes visited and interactions of the force walks")
+	role := flag.String("role", "", "distributed run: coordinator (generates the particles and writes the output), rank (simulates one domain) or inprocess (coordinator and ranks in this process), empty for a single process")
+	addr := flag.String("addr", "localhost:7070", "address the coordinator listens on and the ranks connect to")
+	numRanks := flag.Int("ranks", 2, "number of ranks the coordinator waits for")
+	curve := flag.String("curve", barneshut.CurveMorton, "space-filling curve cut into the rank domains: morton or hilbert")
+	rebalance := flag.Int("rebalance", 10, "iterations between rebalancings of the rank domains by force-walk cost (0 = never)")
+	flag.Parse()
+
 	// Number of particles
 	nParticles := 10000
 	numThreads := 1
 	nIters := 200
 	dt := 1.0
-	args := os.Args
+	args := flag.Args()
 	var visual bool
-	if len(args) > 1 {
-		val, err := strconv.Atoi(args[1])
+	if len(args) > 0 {
+		val, err := strconv.Atoi(args[0])
 		if err == nil {
 			nParticles = val
 		}
 		// Number of threads
-		if len(args) > 2 {
-			val, err := strconv.Atoi(args[2])
+		if len(args) > 1 {
+			val, err := strconv.Atoi(args[1])
 			if err == nil {
 				numThreads = val
 			}
 		}
 		// Iterations
-		if len(args) > 3 {
-			val, err := strconv.Atoi(args[3])
+		if len(args) > 2 {
+			val, err := strconv.Atoi(args[2])
 			if err == nil {
 				nIters = val
 			}
 		}
 		// Visual
-		if len(args) > 4 {
-			val := args[4]
+		if len(args) > 3 {
+			val := args[3]
 			if val == "y" {
 				visual = true
 			} else {
@@ -69,23 +145,162 @@ func main() {
 		}
 	}
 
-	// Create particles
-	particles := make([]*barneshut.Particle, nParticles)
-	for i := 0; i < nParticles; i++ {
-		x := (rand.Float64() * 20000.0) - 10000 // random in [-1,1]
-		y := (rand.Float64() * 20000.0) - 10000
-		p := barneshut.NewParticle(x, y)
-		particles[i] = p
+	if *iterations > 0 {
+		nIters = *iterations
+	}
+	// The trees and schedulers of a distributed run are in the ranks.
+	if (*role == "coordinator" || *role == "inprocess") && *printStats {
+		fmt.Println("-stats is printed by each rank with -role rank, not by the coordinator")
+		return
+	}
+	if *role != "" && *printTreeStats {
+		fmt.Println("-tree-stats is not supported in distributed runs")
+		return
+	}
+
+	schedOpts := barneshut.SchedulerOptions{
+		Name:          *schedulerName,
+		NumThreads:    numThreads,
+		Victim:        *victim,
+		BatchSteal:    *batchSteal,
+		SubtreeCutoff: *subtreeCutoff,
+		DepthCutoff:   *depthCutoff,
+	}
+	sched, err := barneshut.NewScheduler(schedOpts)
+	if err != nil {
+		fmt.Println("Error creating scheduler:", err)
+		return
+	}
+	if *gadgetFormat != 1 && *gadgetFormat != 2 {
+		fmt.Println("Invalid -gadget-format:", *gadgetFormat)
+		return
+	}
+	gadgetUnits := barneshut.GadgetUnits{Length: *gadgetLength, Velocity: *gadgetVelocity, Mass: *gadgetMass}
+	renderOpts, err := barneshut.ParseRenderOptions(*renderSize, *renderView, *renderPoint, *renderColor, *renderDensity)
+	if err != nil {
+		fmt.Println("Error in render options:", err)
+		return
+	}
+	if *treeDump != "" {
+		if _, err := barneshut.TreeDumpWriter(*treeDump); err != nil {
+			fmt.Println("Invalid -tree-dump:", err)
+			return
+		}
+	}
+	svgOpts := barneshut.SVGOptions{
+		Width: renderOpts.Width, Height: renderOpts.Height,
+		MinX: renderOpts.MinX, MaxX: renderOpts.MaxX, MinY: renderOpts.MinY, MaxY: renderOpts.MaxY,
+		HideCells: !*svgCells, Labels: *svgLabels, Highlight: *svgHighlight != "",
+	}
+	if svgOpts.Highlight {
+		if svgOpts.HighlightID, err = strconv.ParseInt(*svgHighlight, 10, 64); err != nil {
+			fmt.Println("Invalid -svg-highlight:", err)
+			return
+		}
 	}
 
-	// Create root node
-	root := barneshut.CreateNode(float64(math.MinInt64), float64(math.MaxInt64), float64(math.MinInt64), float64(math.MaxInt64), nil)
+	// Ctrl-C, kill or the timeout stop the run after the last completed iteration.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	signalCtx := ctx // Outlives the timeout, for the viewer to keep serving the final state.
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
 
-	// Insert particles into the tree
-	for i := 0; i < nParticles; i++ {
-		barneshut.InsertParticle(root, particles[i])
+	// A rank gets its particles and settings from the coordinator.
+	if *role == "rank" {
+		conn, err := barneshut.DialCoordinator(ctx, *addr)
+		if err != nil {
+			fmt.Println("Error connecting to coordinator:", err)
+			return
+		}
+		rankStats, err := barneshut.RunRank(ctx, conn)
+		if err != nil {
+			fmt.Println("Error running rank:", err)
+			return
+		}
+		if *printStats {
+			rankStats.Fprint(os.Stderr)
+		}
+		return
+	}
+
+	// Create particles
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	var particles []*barneshut.Particle
+	var rng *barneshut.RandomSource
+	firstIter := 1
+	if *restart != "" {
+		saved, savedRng, err := barneshut.ReadCheckpoint(*restart)
+		if err != nil {
+			fmt.Println("Error reading checkpoint:", err)
+			return
+		}
+		particles, rng, firstIter = saved.Particles(), savedRng, saved.Header.Step+1
+		nParticles = len(particles)
+		savedParams := saved.Header.Params
+		// The iterations can be extended on the command line.
+		if len(args) <= 2 && *iterations <= 0 {
+			if nIters, err = strconv.Atoi(savedParams["iterations"]); err != nil {
+				fmt.Println("Error reading checkpoint: invalid iterations:", err)
+				return
+			}
+		}
+		if dt, err = strconv.ParseFloat(savedParams["dt"], 64); err != nil {
+			fmt.Println("Error reading checkpoint: invalid dt:", err)
+			return
+		}
+		// The seed names the run in -checksum and the next checkpoints, so it is not left 0.
+		if *seed, err = strconv.ParseInt(savedParams["seed"], 10, 64); err != nil {
+			fmt.Println("Error reading checkpoint: invalid seed:", err)
+			return
+		}
+		*layout, *walk = savedParams["layout"], savedParams["walk"]
+	} else if *input != "" {
+		if barneshut.InputFormat(*input, *inputFormat) == barneshut.FormatGadget {
+			var header *barneshut.GadgetHeader
+			particles, header, err = barneshut.LoadGadgetFile(*input, gadgetUnits)
+			// Particles sharing an x and y are merged, which the run should not hide.
+			if err == nil && len(particles) < header.NumParticles() {
+				fmt.Fprintf(os.Stderr, "Merged the %d particles of %s into %d with distinct x and y\n", header.NumParticles(), *input, len(particles))
+			}
+		} else {
+			particles, err = barneshut.LoadParticlesFile(*input, *inputFormat)
+		}
+		if err != nil {
+			fmt.Println("Error loading particles:", err)
+			return
+		}
+		nParticles = len(particles)
+	} else {
+		rng = barneshut.NewRandomSource(*seed)
+		particles = generateParticles(rand.New(rng), nParticles, *clusters)
+	}
+	if rng == nil {
+		rng = barneshut.NewRandomSource(*seed)
+	}
+	// The soa layout runs its own parallel loops rather than a scheduler.
+	if *role == "" && *layout == "soa" {
+		for _, name := range []string{"scheduler", "victim", "batch", "cutoff", "depth-cutoff"} {
+			if flagGiven(name) {
+				fmt.Printf("-%s has no effect with -layout soa\n", name)
+				return
+			}
+		}
+	}
+	// The IDs do not change during the run, so a missing one is reported before it.
+	if svgOpts.Highlight && !slices.ContainsFunc(particles, func(p *barneshut.Particle) bool { return p.ID() == svgOpts.HighlightID }) {
+		fmt.Printf("Invalid -svg-highlight: no particle with id %d\n", svgOpts.HighlightID)
+		return
 	}
 
+	// Create root node and insert particles into the tree
+	root := buildTree(particles)
+
 	// Open file for writing particle data
 	datafile_input, err := os.Create("particles_input.dat")
 	if err != nil {
@@ -94,7 +309,11 @@ func main() {
 	}
 	defer datafile_input.Close()
 
-	barneshut.FprintDataFile(datafile_input, root)
+	fprintDataFile := barneshut.FprintDataFile
+	if *exact {
+		fprintDataFile = barneshut.FprintDataFileExact
+	}
+	fprintDataFile(datafile_input, root)
 
 	// Open file for writing particle data
 	datafile, err := os.Create("particles_output.dat")
@@ -104,47 +323,443 @@ func main() {
 	}
 	defer datafile.Close()
 
-	if visual {
-		// Running in visual mode.
-		// Start the python realtime plotter.
-		cmd := exec.Command("python3", "space_graph.py", "particles_output.dat", strconv.Itoa(nParticles))
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err := cmd.Start()
+	// Run parameters recorded in the snapshots.
+	params := map[string]string{
+		"particles": strconv.Itoa(nParticles), "threads": strconv.Itoa(numThreads), "iterations": strconv.Itoa(nIters),
+		"dt": strconv.FormatFloat(dt, 'g', -1, 64), "theta": strconv.FormatFloat(barneshut.THETA, 'g', -1, 64),
+		"softening": strconv.FormatFloat(barneshut.SOFTENING, 'g', -1, 64), "seed": strconv.FormatInt(*seed, 10),
+		"scheduler": sched.Name(), "layout": *layout, "walk": *walk, "input": *input, "role": *role,
+	}
+	lastCheckpoint := time.Now()
+	writeCheckpoint := func(step int) {
+		header := barneshut.SnapshotHeader{Step: step, Time: float64(step) * dt, Params: params}
+		if err := barneshut.WriteCheckpoint(*checkpoint, header, particles, rng); err != nil {
+			fmt.Println("Error writing checkpoint:", err)
+		}
+		lastCheckpoint = time.Now()
+	}
+	// The frames share the viewport of the initial particles.
+	renderOpts = renderOpts.FitViewport(particles)
+	writeFrame := func(path string) {
+		if err := barneshut.WritePNGFrame(path, particles, renderOpts); err != nil {
+			fmt.Println("Error rendering frame:", err)
+		}
+	}
+	writeSVG := func() {
+		if err := barneshut.WriteSVGFile(*svg, particles, svgOpts); err != nil {
+			fmt.Println("Error writing SVG:", err)
+		}
+	}
+	writeTreeDump := func() {
+		if err := barneshut.WriteTreeFile(*treeDump, particles, *treeDepth); err != nil {
+			fmt.Println("Error writing tree dump:", err)
+		}
+	}
+	// The visual mode serves the live view in the browser.
+	if visual && *viewerAddr == "" {
+		*viewerAddr = "localhost:8080"
+	}
+	if visual && !flagGiven("viewer-linger") {
+		*viewerLinger = true
+	}
+	var viewer *barneshut.Viewer
+	if *viewerAddr != "" {
+		viewer = barneshut.NewViewer(barneshut.ViewerOptions{MaxFPS: *viewerFPS, MaxPoints: *viewerPoints})
+		viewerListen, err := viewer.ListenAndServe(signalCtx, *viewerAddr)
 		if err != nil {
-			panic(err)
+			fmt.Println("Error starting viewer:", err)
+			return
 		}
-		defer cmd.Process.Kill()
+		fmt.Fprintf(os.Stderr, "Viewer at http://%s/\n", viewerListen)
+		viewer.Show(firstIter-1, float64(firstIter-1)*dt, particles)
+	}
+	// With -viewer-linger, keeps serving the final state until Ctrl-C, after the
+	// deferred outputs below are written.
+	finalStep := -1 // Set once the run has a final state.
+	defer func() {
+		if viewer == nil || finalStep < 0 || !*viewerLinger {
+			return
+		}
+		viewer.Show(finalStep, float64(finalStep)*dt, particles)
+		if signalCtx.Err() == nil {
+			fmt.Fprintln(os.Stderr, "Run finished, the viewer shows the final state until Ctrl-C")
+			<-signalCtx.Done()
+		}
+	}()
+	var display *barneshut.TerminalDisplay
+	if *term {
+		opts, err := terminalOptions(*termSize, *termMode)
+		if err != nil {
+			fmt.Println("Error in terminal options:", err)
+			return
+		}
+		display = barneshut.NewTerminalDisplay(os.Stderr, opts)
+		defer display.Close()
+		display.Draw(firstIter-1, nIters, float64(firstIter-1)*dt, particles)
+	}
+	var recorder *barneshut.Movie
+	if *movie != "" {
+		opts := barneshut.MovieOptions{Render: renderOpts, FPS: *movieFPS, Track: *movieTrack, Annotate: *movieAnnotate}
+		if recorder, err = barneshut.NewMovie(*movie, opts); err != nil {
+			fmt.Println("Error creating movie:", err)
+			return
+		}
+		defer func() {
+			if err := recorder.Close(); err != nil {
+				fmt.Println("Error writing movie:", err)
+			}
+		}()
+		if err := recorder.AddFrame(firstIter-1, float64(firstIter-1)*dt, particles); err != nil {
+			fmt.Println("Error rendering movie frame:", err)
+		}
+	}
+	// The last steps drawn and recorded, so the final state is not added twice.
+	termStep, movieStep := firstIter-1, firstIter-1
+	drawTerminal := func(step int) {
+		display.Draw(step, nIters, float64(step)*dt, particles)
+		termStep = step
+	}
+	addMovieFrame := func(step int) {
+		if err := recorder.AddFrame(step, float64(step)*dt, particles); err != nil {
+			fmt.Println("Error rendering movie frame:", err)
+		}
+		movieStep = step
+	}
+	// The VTK snapshots written so far, collected in a .pvd file next to -snapshot.
+	var pvdEntries []barneshut.PVDEntry
+	writeSnapshot := func(path string, step int) {
+		header := barneshut.SnapshotHeader{Step: step, Time: float64(step) * dt, Params: params}
+		var err error
+		switch ext := filepath.Ext(path); {
+		case strings.EqualFold(ext, ".bhs"):
+			opts := barneshut.BinarySnapshotOptions{Float32: *snapshotFloat32, Deflate: *snapshotDeflate}
+			err = barneshut.WriteBinarySnapshotFile(path, header, particles, opts)
+		case strings.EqualFold(ext, ".vtp"):
+			// The final snapshot of an iteration already written by -snapshot-every is
+			// not added to the collection again.
+			collect := len(pvdEntries) == 0 || pvdEntries[len(pvdEntries)-1].Time != header.Time
+			err = barneshut.WriteVTKParticlesFile(path, header, particles)
+			if collect {
+				pvdEntries = append(pvdEntries, barneshut.PVDEntry{Time: header.Time, File: path})
+			}
+			if err == nil && *snapshotTree {
+				treePath := strings.TrimSuffix(path, ext) + "_tree.vtu"
+				err = barneshut.WriteVTKTreeFile(treePath, header, particles)
+				if collect {
+					pvdEntries = append(pvdEntries, barneshut.PVDEntry{Time: header.Time, Part: 1, File: treePath})
+				}
+			}
+			if err == nil && collect {
+				err = barneshut.WritePVD(strings.TrimSuffix(*snapshot, filepath.Ext(*snapshot))+".pvd", pvdEntries)
+			}
+		case strings.EqualFold(ext, ".npz"):
+			err = barneshut.WriteNPZFile(path, header, particles)
+		case strings.EqualFold(ext, ".npy"):
+			err = barneshut.WriteNPYFiles(path, header, particles)
+		case strings.EqualFold(ext, ".gadget"):
+			opts := barneshut.GadgetOptions{Format: *gadgetFormat, Double: *gadgetDouble, Units: gadgetUnits}
+			err = barneshut.WriteGadgetFile(path, header, particles, opts)
+		default:
+			err = barneshut.WriteSnapshotFile(path, header, particles)
+		}
+		if err != nil {
+			fmt.Println("Error writing snapshot:", err)
+		}
+	}
+	// The outputs of the final state, the same after a run in this process and a
+	// distributed one. root is the tree of the final particles.
+	writeFinal := func(step int, root *barneshut.BarnesHutNode, elapsedTime time.Duration) {
+		if display != nil && termStep != step {
+			drawTerminal(step)
+		}
+		fprintDataFile(datafile, root)
+		fmt.Println(elapsedTime.Seconds())
+		if *snapshot != "" {
+			writeSnapshot(*snapshot, step)
+		}
+		if *render != "" {
+			writeFrame(*render)
+		}
+		if *svg != "" {
+			writeSVG()
+		}
+		if *treeDump != "" {
+			writeTreeDump()
+		}
+		if recorder != nil && movieStep != step {
+			addMovieFrame(step)
+		}
+		if *checksum {
+			fmt.Fprintf(os.Stderr, "seed: %d, checksum: %016x\n", *seed, barneshut.Checksum(root))
+		}
+		finalStep = step
+	}
+
+	if *role == "coordinator" || *role == "inprocess" {
+		config := barneshut.DistributedConfig{Steps: nIters, Dt: dt, Scheduler: schedOpts, Curve: *curve, RebalanceEvery: *rebalance}
+		steps, elapsedTime, ok := runCoordinator(ctx, *role == "inprocess", *addr, *numRanks, particles, config)
+		if !ok {
+			return
+		}
+		// The ranks hold the particles during the run, so only the final state is output.
+		writeFinal(steps, buildTree(particles), elapsedTime)
+		return
+	}
+
+	trajectoryPath := *trajectory
+	var traj *barneshut.TrajectoryWriter
+	if trajectoryPath != "" {
+		opts := barneshut.TrajectoryOptions{Every: *trajectoryEvery, Stride: *trajectoryStride, Velocities: *trajectoryVelocities}
+		if *restart != "" {
+			traj, err = barneshut.ResumeTrajectory(trajectoryPath, opts, firstIter-1)
+		} else {
+			traj, err = barneshut.CreateTrajectory(trajectoryPath, opts)
+			if err == nil {
+				err = traj.WriteFrame(0, 0, particles)
+			}
+		}
+		if err != nil {
+			fmt.Println("Error opening trajectory:", err)
+			return
+		}
+		defer traj.Close()
+	}
+
+	// The structure of arrays layout keeps its own tree and only fills in the
+	// particles and their tree for output.
+	var set *barneshut.ParticleSet
+	switch *layout {
+	case "tree":
+	case "soa":
+		set = barneshut.NewParticleSet(particles)
+		if err := set.SetWalk(*walk); err != nil {
+			fmt.Println("Error selecting walk:", err)
+			return
+		}
+	default:
+		fmt.Println("Unknown layout:", *layout)
+		return
 	}
 
 	// Main loop
+	var stats barneshut.Stats
+	var walkVisits, walkInteractions int64
+	var treeStats barneshut.TreeStats
+	completed := firstIter - 1
 	startTime := time.Now()
-	for iter := 1; iter <= nIters; iter++ {
+	for iter := firstIter; iter <= nIters; iter++ {
 		// fmt.Printf("iteration:%d\n", iter)
-		newRoot := barneshut.CreateNode(float64(math.MinInt64), float64(math.MaxInt64), float64(math.MinInt64), float64(math.MaxInt64), nil)
-		// Run the N-Body Simulation
-		barneshut.RunSimulation(root, numThreads, dt, nParticles)
-		// Recreate the tree with new positons
-		barneshut.RecreateWithNewPos(root, newRoot)
-		root = newRoot
-
-		if visual {
-			// Truncate the file to clear old contents
-			if err := datafile.Truncate(0); err != nil {
-				fmt.Println("Error truncating datafile:", err)
-				return
+		if set != nil {
+			if err := ctx.Err(); err != nil {
+				fmt.Fprintf(os.Stderr, "Stopped after %d of %d iterations: %v\n", iter-1, nIters, err)
+				break
+			}
+			set.Step(dt, numThreads)
+			visits, interactions := set.WalkStats()
+			walkVisits += visits
+			walkInteractions += interactions
+			if *printTreeStats {
+				treeStats = set.TreeStats()
+			}
+		} else {
+			newRoot := newRootNode()
+			// Run the N-Body Simulation
+			stepStats, err := barneshut.RunSimulationContext(ctx, root, sched, dt, nParticles)
+			stats.Add(stepStats)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Stopped after %d of %d iterations: %v\n", iter-1, nIters, err)
+				break
 			}
+			if *printTreeStats {
+				// The tree of this step, with the interactions of its force walk.
+				treeStats = barneshut.ComputeTreeStats(root)
+			}
+			// Recreate the tree with new positons
+			barneshut.RecreateWithNewPos(root, newRoot)
+			root = newRoot
+		}
+		completed = iter
+		if *printTreeStats {
+			fmt.Fprintf(os.Stderr, "tree %d: %s\n", iter, treeStats.Summary())
+		}
+
+		if *snapshot != "" && *snapshotEvery > 0 && iter%*snapshotEvery == 0 {
+			if set != nil {
+				set.Store(particles)
+			}
+			writeSnapshot(numberedPath(*snapshot, iter), iter)
+		}
+		if *checkpoint != "" && ((*checkpointEvery > 0 && iter%*checkpointEvery == 0) ||
+			(*checkpointInterval > 0 && time.Since(lastCheckpoint) >= *checkpointInterval)) {
+			if set != nil {
+				set.Store(particles)
+			}
+			writeCheckpoint(iter)
+		}
 
-			// Reset the file offset to the start
-			if _, err := datafile.Seek(0, 0); err != nil {
-				fmt.Println("Error seeking datafile:", err)
+		if *render != "" && *renderEvery > 0 && iter%*renderEvery == 0 {
+			if set != nil {
+				set.Store(particles)
+			}
+			writeFrame(numberedPath(*render, iter))
+		}
+		if recorder != nil && iter%max(*movieEvery, 1) == 0 {
+			if set != nil {
+				set.Store(particles)
+			}
+			addMovieFrame(iter)
+		}
+		if display != nil && iter%max(*termEvery, 1) == 0 {
+			if set != nil {
+				set.Store(particles)
+			}
+			drawTerminal(iter)
+		}
+		if viewer != nil && viewer.Due() {
+			if set != nil {
+				set.Store(particles)
+			}
+			viewer.Publish(iter, float64(iter)*dt, particles)
+		}
+		if traj != nil && traj.Due(iter) {
+			if set != nil {
+				set.Store(particles)
+			}
+			if err := traj.WriteFrame(iter, float64(iter)*dt, particles); err != nil {
+				fmt.Println("Error writing trajectory:", err)
 				return
 			}
-			barneshut.FprintDataFile(datafile, root)
 		}
 	}
 	endTime := time.Now()
 	elapsedTime := endTime.Sub(startTime)
-	barneshut.FprintDataFile(datafile, root)
-	fmt.Println(elapsedTime.Seconds())
+	if set != nil {
+		set.Store(particles)
+		root = buildTree(particles)
+	}
+	writeFinal(completed, root, elapsedTime)
+	// The final state, also of a run stopped early, to continue or extend it later.
+	if *checkpoint != "" {
+		writeCheckpoint(completed)
+	}
+	if *printTreeStats && completed >= firstIter {
+		treeStats.Fprint(os.Stderr)
+	}
+	if *printStats {
+		if set != nil {
+			fmt.Fprintf(os.Stderr, "walk: %s, nodes visited: %d, interactions: %d\n", *walk, walkVisits, walkInteractions)
+		} else {
+			stats.Fprint(os.Stderr)
+		}
+	}
+}
+
+// Whether the flag was set on the command line rather than left at its default.
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		given = given || f.Name == name
+	})
+	return given
+}
+
+/*
+** Terminal map options from their command-line forms: the size as COLUMNSxROWS, or
+** empty for the size of the terminal the shell exports.
+ */
+func terminalOptions(size string, mode string) (barneshut.TerminalOptions, error) {
+	opts := barneshut.TerminalOptions{Mode: mode}
+	if mode != barneshut.TerminalBraille && mode != barneshut.TerminalBlocks {
+		return opts, fmt.Errorf("unknown mode %q, want braille or blocks", mode)
+	}
+	if size == "" {
+		opts.Columns, _ = strconv.Atoi(os.Getenv("COLUMNS"))
+		opts.Rows, _ = strconv.Atoi(os.Getenv("LINES"))
+		return opts, nil
+	}
+	if _, err := fmt.Sscanf(size, "%dx%d", &opts.Columns, &opts.Rows); err != nil || opts.Columns <= 0 || opts.Rows <= 0 {
+		return opts, fmt.Errorf("invalid size %q, want COLUMNSxROWS", size)
+	}
+	return opts, nil
+}
+
+/*
+** Runs the coordinator of a distributed run, with the ranks in this process if
+** inProcess. Returns the completed iterations and whether there is a state to write.
+ */
+func runCoordinator(ctx context.Context, inProcess bool, addr string, numRanks int, particles []*barneshut.Particle,
+	config barneshut.DistributedConfig) (int, time.Duration, bool) {
+	var steps int
+	var err error
+	var elapsedTime time.Duration
+	if inProcess {
+		startTime := time.Now()
+		steps, err = barneshut.RunInProcess(ctx, numRanks, particles, config)
+		elapsedTime = time.Since(startTime)
+	} else {
+		listener, listenErr := net.Listen("tcp", addr)
+		if listenErr != nil {
+			fmt.Println("Error listening:", listenErr)
+			return 0, 0, false
+		}
+		defer listener.Close()
+		conns, acceptErr := barneshut.AcceptRanks(ctx, listener, numRanks)
+		if acceptErr != nil {
+			fmt.Println("Error waiting for ranks:", acceptErr)
+			return 0, 0, false
+		}
+		startTime := time.Now()
+		steps, err = barneshut.RunCoordinator(ctx, conns, particles, config)
+		elapsedTime = time.Since(startTime)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Stopped after %d of %d iterations: %v\n", steps, config.Steps, err)
+		if steps == 0 && ctx.Err() == nil {
+			return 0, 0, false
+		}
+	}
+	return steps, elapsedTime, true
+}
+
+// Inserts _<step> before the extension: snap.txt -> snap_000010.txt.
+func numberedPath(path string, step int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s_%06d%s", strings.TrimSuffix(path, ext), step, ext)
+}
+
+/*
+** Generates n particles at rest, uniformly in the square of side 20000 around the
+** origin or in gaussian clusters, with IDs in order.
+ */
+func generateParticles(rng *rand.Rand, n int, clusters int) []*barneshut.Particle {
+	particles := make([]*barneshut.Particle, n)
+	centers := make([][2]float64, clusters)
+	for c := range centers {
+		centers[c] = [2]float64{(rng.Float64() * 16000.0) - 8000, (rng.Float64() * 16000.0) - 8000}
+	}
+	for i := 0; i < n; i++ {
+		x := (rng.Float64() * 20000.0) - 10000 // random in [-1,1]
+		y := (rng.Float64() * 20000.0) - 10000
+		if len(centers) > 0 {
+			center := centers[rng.Intn(len(centers))]
+			x = center[0] + rng.NormFloat64()*500.0
+			y = center[1] + rng.NormFloat64()*500.0
+		}
+		p := barneshut.NewParticle(x, y)
+		p.SetID(int64(i))
+		particles[i] = p
+	}
+	return particles
+}
+
+func newRootNode() *barneshut.BarnesHutNode {
+	return barneshut.CreateNode(float64(math.MinInt64), float64(math.MaxInt64), float64(math.MinInt64), float64(math.MaxInt64), nil)
+}
+
+func buildTree(particles []*barneshut.Particle) *barneshut.BarnesHutNode {
+	root := newRootNode()
+	for _, particle := range particles {
+		barneshut.InsertParticle(root, particle)
+	}
+	return root
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"barnes-hut-parallel/src/barneshut"
+)
+
+/*
+** The checksum of go run main.go -seed=5 -checksum 2000 <threads> 20, which must not
+** depend on the scheduler or the thread count. A change to the physics, the tree or
+** the generated particles changes it, and then the new value goes here.
+ */
+const seed5Checksum = 0xdf0f158369c04f9f
+
+func TestChecksumAcrossSchedulers(t *testing.T) {
+	schedulers := []barneshut.SchedulerOptions{{Name: barneshut.SchedulerSequential}}
+	for _, name := range []string{barneshut.SchedulerGoroutine, barneshut.SchedulerWorkStealing, barneshut.SchedulerStatic, barneshut.SchedulerCostzones} {
+		for _, threads := range []int{1, 2, 4, 8} {
+			schedulers = append(schedulers, barneshut.SchedulerOptions{Name: name, NumThreads: threads})
+		}
+	}
+	for _, victim := range []string{barneshut.VictimRandom, barneshut.VictimBackoff, barneshut.VictimHierarchical} {
+		schedulers = append(schedulers, barneshut.SchedulerOptions{Name: barneshut.SchedulerWorkStealing, NumThreads: 4, Victim: victim, BatchSteal: true})
+	}
+	for _, opts := range schedulers {
+		t.Run(fmt.Sprintf("%s/%d/%s", opts.Name, opts.NumThreads, opts.Victim), func(t *testing.T) {
+			sched, err := barneshut.NewScheduler(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			particles := generateParticles(rand.New(barneshut.NewRandomSource(5)), 2000, 0)
+			root := buildTree(particles)
+			for iter := 1; iter <= 20; iter++ {
+				newRoot := newRootNode()
+				if _, err := barneshut.RunSimulationContext(context.Background(), root, sched, 1, len(particles)); err != nil {
+					t.Fatal(err)
+				}
+				barneshut.RecreateWithNewPos(root, newRoot)
+				root = newRoot
+			}
+			if checksum := barneshut.Checksum(root); checksum != seed5Checksum {
+				t.Errorf("checksum %016x, want %016x", checksum, uint64(seed5Checksum))
+			}
+		})
+	}
+}
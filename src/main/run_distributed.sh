@@ -0,0 +1,16 @@
+#!/bin/bash
+# Runs a distributed simulation on localhost: one coordinator and <ranks> rank processes.
+# Usage: ./run_distributed.sh <ranks> [flags and arguments for the coordinator...]
+# e.g.   ./run_distributed.sh 4 -seed=42 -exact 10000 2 50
+
+RANKS=${1:-2}
+shift
+ADDR=${ADDR:-localhost:7070}
+
+go build -o barneshut_dist main.go || exit 1
+for ((r = 0; r < RANKS; r++)); do
+    ./barneshut_dist -role=rank -addr="$ADDR" &
+done
+./barneshut_dist -role=coordinator -ranks="$RANKS" -addr="$ADDR" "$@"
+wait
+rm -f barneshut_dist
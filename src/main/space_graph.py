@@ -1,7 +1,37 @@
 import matplotlib.pyplot as plt
 import os
+import struct
 import time
 import sys
+import zlib
+
+def read_trajectory(filename):
+    # Positions of the last complete frame of a trajectory file (see trajectory.go).
+    x, y = [], []
+    try:
+        with open(filename, 'rb') as f:
+            data = f.read()
+        if data[:6] != b'BHTRAJ':
+            print("Not a trajectory file:", filename)
+            return x, y
+        offset, last = 12, None
+        while offset + 8 <= len(data) and data[offset:offset + 4] == b'FRAM':
+            (length,) = struct.unpack_from('<I', data, offset + 4)
+            end = offset + 8 + length
+            if end + 4 > len(data):
+                break  # Frame still being written.
+            payload = data[offset + 8:end]
+            if zlib.crc32(payload) != struct.unpack_from('<I', data, end)[0]:
+                break
+            last = payload
+            offset = end + 4
+        if last is not None:
+            (n,) = struct.unpack_from('<q', last, 16)
+            x = list(struct.unpack_from('<%dd' % n, last, 24 + 8 * n))
+            y = list(struct.unpack_from('<%dd' % n, last, 24 + 16 * n))
+    except Exception as e:
+        print("Error reading file:", e)
+    return x, y
 
 def read_data(filename, expected_lines):
     x, y = [], []
@@ -23,7 +53,10 @@ def read_data(filename, expected_lines):
     return x, y
 
 def update_plot(fig, ax, filename, expected_lines, xlim=(-20000, 20000), ylim=(-20000, 20000)):
-    x, y = read_data(filename, expected_lines)
+    if expected_lines is None:
+        x, y = read_trajectory(filename)
+    else:
+        x, y = read_data(filename, expected_lines)
     if not x or not y:  # Skip update if no data was read
         return
 
@@ -71,16 +104,19 @@ def monitor_file(filename, expected_lines, interval=0.5):
             time.sleep(interval)
 
 if __name__ == "__main__":
-    # Get the filename and expected number of particles from command-line arguments
-    if len(sys.argv) != 3:
-        print("Usage: python script.py <filename> <expected_lines>")
+    # Get the trajectory file, or a .dat file and the expected number of particles,
+    # from command-line arguments
+    if len(sys.argv) not in (2, 3):
+        print("Usage: python script.py <trajectory.bht> | <filename.dat> <expected_lines>")
         sys.exit(1)
 
     filename = sys.argv[1]
-    try:
-        expected_lines = int(sys.argv[2])
-    except ValueError:
-        print("Error: expected_lines must be an integer.")
-        sys.exit(1)
+    expected_lines = None
+    if len(sys.argv) == 3:
+        try:
+            expected_lines = int(sys.argv[2])
+        except ValueError:
+            print("Error: expected_lines must be an integer.")
+            sys.exit(1)
 
     monitor_file(filename, expected_lines, interval=1)
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"barnes-hut-parallel/src/barneshut"
+	"flag"
+	"fmt"
+	"os"
+)
+
+/*
+** Renders a trajectory into an animated GIF or a numbered PNG sequence.
+**
+**	go run ./src/movie [flags] trajectory.bht movie.gif|movie.png
+ */
+func main() {
+	fps := flag.Float64("fps", 10, "frames per second")
+	stride := flag.Int("stride", 1, "use every this many trajectory frames")
+	size := flag.String("size", "800x800", "size of the frames in pixels, WIDTHxHEIGHT")
+	view := flag.String("view", "", "viewport, minX,maxX,minY,maxY (default: the first frame's bounds)")
+	point := flag.Int("point", 1, "diameter of a particle in pixels")
+	colorBy := flag.String("color", "", "color the particles by speed, which needs a trajectory with velocities (default: a single color)")
+	density := flag.Bool("density", false, "shade the pixels by the log of the number of particles on them")
+	track := flag.Bool("track", false, "keep the center of mass in the middle of the frame")
+	annotate := flag.Bool("annotate", true, "draw the step and time into each frame")
+	flag.Parse()
+	if flag.NArg() != 2 || *stride < 1 {
+		fmt.Fprintln(os.Stderr, "usage: movie [flags] trajectory.bht movie.gif|movie.png")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	render, err := barneshut.ParseRenderOptions(*size, *view, *point, *colorBy, *density)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	reader, err := barneshut.OpenTrajectory(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer reader.Close()
+	if render.Color == barneshut.ColorSpeed && !reader.HasVelocities() {
+		fmt.Fprintf(os.Stderr, "%s has no velocities, write it with -trajectory-velocities\n", flag.Arg(0))
+		os.Exit(1)
+	}
+	if render.Color == barneshut.ColorMass {
+		fmt.Fprintln(os.Stderr, "trajectories hold no masses, use -color speed")
+		os.Exit(1)
+	}
+
+	movie, err := barneshut.NewMovie(flag.Arg(1), barneshut.MovieOptions{Render: render, FPS: *fps, Track: *track, Annotate: *annotate})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for i := 0; i < reader.NumFrames(); i += *stride {
+		frame, err := reader.Frame(i)
+		if err == nil {
+			err = movie.AddFrame(frame.Step, frame.Time, frame.Particles())
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if err := movie.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: %d frames\n", flag.Arg(1), movie.Frames())
+}